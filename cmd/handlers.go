@@ -1,15 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"wallplayer/pkg/browse"
+	"wallplayer/pkg/events"
+	"wallplayer/pkg/indexer"
 	"wallplayer/pkg/player"
+	"wallplayer/pkg/search"
 	"wallplayer/pkg/video"
 	"wallplayer/web"
 )
@@ -34,6 +42,26 @@ func setContentType(w http.ResponseWriter, path string) {
 	}
 }
 
+// immutable serves generated files, whose names change with the video they
+// come from: they can be cached forever. Errors are not, a missing subtitle
+// may be extracted later.
+func immutable(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(immutableWriter{w}, r)
+	})
+}
+
+type immutableWriter struct {
+	http.ResponseWriter
+}
+
+func (w immutableWriter) WriteHeader(code int) {
+	if code == http.StatusOK || code == http.StatusPartialContent || code == http.StatusNotModified {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
 // redirectRoot redirects "/" to "/static/index.html" and returns 404 for other paths
 func redirectRoot(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/" {
@@ -44,21 +72,24 @@ func redirectRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 // setupStaticHandlers configures static file serving for dev and prod modes
-func setupStaticHandlers(devMode bool) {
+func setupStaticHandlers(mux *http.ServeMux, devMode bool) {
 	// Handle root path
-	http.HandleFunc("/", redirectRoot)
+	mux.HandleFunc("/", redirectRoot)
 
 	if devMode {
 		log.Println("Running in development mode")
 		fs := http.FileServer(http.Dir("web/static"))
-		http.Handle("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Handle("/static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			setContentType(w, r.URL.Path)
 			http.StripPrefix("/static/", fs).ServeHTTP(w, r)
 		}))
 	} else {
 		log.Println("Running in production mode")
+		if _, err := web.StaticFiles.Open("static/js/hls.min.js"); err != nil {
+			log.Println("hls.min.js is missing, run make vendor before building: videos encoded to HLS only play in Safari")
+		}
 		// Handle static files with special handling for index.html
-		http.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
+		mux.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
 			// Strip /static/ prefix from path
 			path := strings.TrimPrefix(r.URL.Path, "/static/")
 
@@ -103,56 +134,76 @@ func handleBrowseHTML(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	items, err := browse.List(path)
+	opts, err := browse.ParseOptions(r.URL.Query())
 	if err != nil {
-		if err == browse.ErrInvalidPath {
-			http.Error(w, "Invalid path", http.StatusBadRequest)
-		} else {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	html := `<ul class="file-list">`
-	if path != "/" {
-		parentPath := filepath.Dir(path)
-		if parentPath == "." {
-			parentPath = "/"
-		}
-		html += fmt.Sprintf(`
-			<li hx-get="/api/browse/html?path=%s" hx-trigger="click" hx-target="#path-browser">
-				<span class="material-symbols-rounded">folder</span>
-				<span>..</span>
-			</li>`, parentPath)
-	}
-
-	for _, item := range items {
-		if item.Type == "directory" {
-			html += fmt.Sprintf(`
-				<li hx-get="/api/browse/html?path=%s" hx-trigger="click" hx-target="#path-browser">
-					<span class="material-symbols-rounded">folder</span>
-					<span>%s</span>
-				</li>`, item.Path, formatName(item.Name))
-		} else {
-			durationStr := "⋯"
-			if item.Duration > 0 {
-				minutes := int(item.Duration / 60)
-				seconds := int(item.Duration) % 60
-				durationStr = fmt.Sprintf("%02d:%02d", minutes, seconds)
-			}
-			html += fmt.Sprintf(`
-				<li onclick="playVideo('%s')">
-					<span class="material-symbols-rounded video" data-hide-in-expanded="true">movie_info</span>
-					<img class="thumbnail" src="/api/video/thumbnail?path=%s" loading="lazy" alt="">
-					<span class="name">%s</span>
-					<span class="duration">%s</span>
-				</li>`, item.Path, item.Path, formatName(item.Name), durationStr)
-		}
+	items, err := browse.List(r.Context(), path, opts)
+	if err != nil {
+		pathError(w, err)
+		return
+	}
+
+	listingPath := browse.CleanListingPath(path)
+	renderTemplate(w, "browse", struct {
+		Path      string
+		Parent    string
+		HasParent bool
+		Items     []browse.Item
+	}{
+		Path:      listingPath,
+		Parent:    browse.CleanListingPath(filepath.Dir(listingPath)),
+		HasParent: listingPath != "/",
+		Items:     items,
+	})
+}
+
+// renderTemplate executes a fragment template, nothing is written on error
+func renderTemplate(w http.ResponseWriter, name string, data any) {
+	var buf bytes.Buffer
+	if err := templates.Load().ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("Error rendering template %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func handleSearchAPI(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	results := search.Search(query)
+	if results == nil {
+		results = []search.Result{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Query string          `json:"query"`
+		Items []search.Result `json:"items"`
+	}{
+		Query: query,
+		Items: results,
+	})
+}
+
+// handleSearchHTML renders search results as a file list fragment.
+// An empty query goes back to the root folder listing.
+func handleSearchHTML(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Redirect(w, r, "/api/browse/html?path=/", http.StatusFound)
+		return
 	}
-	html += "</ul>"
 
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
+	renderTemplate(w, "search", struct {
+		Query   string
+		Results []search.Result
+	}{
+		Query:   query,
+		Results: search.Search(query),
+	})
 }
 
 func handleBrowseAPI(w http.ResponseWriter, r *http.Request) {
@@ -160,14 +211,14 @@ func handleBrowseAPI(w http.ResponseWriter, r *http.Request) {
 	if path == "" {
 		path = "/"
 	}
-	fullPath := filepath.Join(browse.BaseDir, path)
-	items, err := browse.List(fullPath)
+	opts, err := browse.ParseOptions(r.URL.Query())
 	if err != nil {
-		if err == browse.ErrInvalidPath {
-			http.Error(w, "Invalid path", http.StatusBadRequest)
-		} else {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := browse.List(r.Context(), path, opts)
+	if err != nil {
+		pathError(w, err)
 		return
 	}
 	response := struct {
@@ -181,43 +232,79 @@ func handleBrowseAPI(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-func handleVideoAPI(w http.ResponseWriter, r *http.Request) {
+// videoPath resolves the path parameter of a video request, on failure the
+// error response is written and ok is false
+func videoPath(w http.ResponseWriter, r *http.Request) (fullPath string, ok bool) {
 	path := r.URL.Query().Get("path")
 	if path == "" {
 		http.Error(w, "path parameter required", http.StatusBadRequest)
+		return "", false
+	}
+	fullPath, err := browse.Resolve(path)
+	if err != nil {
+		pathError(w, err)
+		return "", false
+	}
+	return fullPath, true
+}
+
+// pathError writes the response for an error of browse.Resolve or browse.List
+func pathError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, browse.ErrInvalidPath):
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func handleVideoAPI(w http.ResponseWriter, r *http.Request) {
+	fullPath, ok := videoPath(w, r)
+	if !ok {
 		return
 	}
-	fullPath := filepath.Join(browse.BaseDir, path)
-	info, err := video.GetInfo(fullPath)
+	info, err := video.GetInfo(r.Context(), fullPath)
 	if err != nil {
 		log.Printf("Error getting video info: %v", err)
-		http.Error(w, "Error reading video info", http.StatusInternalServerError)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "Error reading video info", http.StatusInternalServerError)
+		}
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(struct {
-		Path string           `json:"path"`
-		Type string           `json:"type"`
-		Info *video.VideoInfo `json:"info"`
+		Path     string           `json:"path"`
+		Type     string           `json:"type"`
+		Playback video.Playback   `json:"playback"` // Stream or HLS playlist, see video.PlaybackOf
+		Info     *video.VideoInfo `json:"info"`
 	}{
-		Path: path,
-		Type: "video",
-		Info: info,
+		Path:     r.URL.Query().Get("path"),
+		Type:     "video",
+		Playback: video.PlaybackOf(fullPath, info),
+		Info:     info,
 	})
 }
 
 func handleVideoSubtitle(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Query().Get("path")
 	lang := r.URL.Query().Get("lang")
-	if path == "" || lang == "" {
-		http.Error(w, "path and lang parameters required", http.StatusBadRequest)
+	if lang == "" {
+		http.Error(w, "lang parameter required", http.StatusBadRequest)
 		return
 	}
-	fullPath := filepath.Join(browse.BaseDir, path)
-	subtitlePath, err := video.EnsureSubtitle(fullPath, lang)
+	fullPath, ok := videoPath(w, r)
+	if !ok {
+		return
+	}
+	subtitlePath, err := video.EnsureSubtitle(r.Context(), fullPath, lang)
 	if err != nil {
 		log.Printf("Error handling subtitle: %v", err)
 		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			http.NotFound(w, r)
 		case strings.Contains(err.Error(), "no subtitle found for language"):
 			http.Error(w, err.Error(), http.StatusNotFound)
 		default:
@@ -229,19 +316,40 @@ func handleVideoSubtitle(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleVideoThumbnail(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Query().Get("path")
-	if path == "" {
-		http.Error(w, "path parameter required", http.StatusBadRequest)
+	fullPath, ok := videoPath(w, r)
+	if !ok {
+		return
+	}
+	thumbPath, err := video.Thumbnail(r.Context(), fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
 		return
 	}
-	fullPath := filepath.Join(browse.BaseDir, path)
-	thumbPath, err := video.GenerateThumbnail(fullPath)
 	if err != nil {
 		log.Printf("Error generating thumbnail: %v", err)
-		http.Error(w, "Error generating thumbnail", http.StatusInternalServerError)
+		http.Redirect(w, r, "/static/img/no-preview.jpg", http.StatusFound)
+		return
+	}
+
+	file, err := os.Open(thumbPath)
+	if err != nil {
+		http.Error(w, "Error reading thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Error reading thumbnail", http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, thumbPath, http.StatusFound)
+
+	// The file name is derived from the video size and mtime, so it is a strong validator.
+	// ServeContent answers If-None-Match / If-Modified-Since with 304.
+	// The URL names the video, not the thumbnail: caches must revalidate.
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(thumbPath), ".jpg")+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, thumbPath, stat.ModTime(), file)
 }
 
 func handleVideoStream(w http.ResponseWriter, r *http.Request) {
@@ -254,6 +362,11 @@ func handleVideoStream(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if err == player.ErrInvalidPath {
 			http.Error(w, "Invalid path", http.StatusBadRequest)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else if errors.Is(err, video.ErrBusy) {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Too many videos remuxed at once", http.StatusServiceUnavailable)
 		} else {
 			log.Printf("Streaming error: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -261,3 +374,115 @@ func handleVideoStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// handleHLS serves the master playlist /api/video/hls/<path>/index.m3u8, the
+// playlists of the renditions /api/video/hls/<path>/<rendition>/index.m3u8
+// and their segments /api/video/hls/<path>/<rendition>/segment-<n>.ts. The
+// video path is in the URL so playlists can name the files relative to them.
+func handleHLS(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/video/hls/")
+	i := strings.LastIndex(rest, "/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	path, name := rest[:i], rest[i+1:]
+	// Videos have an extension, renditions don't
+	var rendition string
+	if i := strings.LastIndex(path, "/"); i >= 0 && filepath.Ext(path[i+1:]) == "" {
+		path, rendition = path[:i], path[i+1:]
+	}
+	fullPath, err := browse.Resolve(path)
+	if err != nil {
+		pathError(w, err)
+		return
+	}
+	if !browse.IsVideo(fullPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if name == "index.m3u8" {
+		var playlist string
+		if rendition == "" {
+			playlist, err = video.HLSMasterPlaylist(r.Context(), fullPath)
+		} else {
+			playlist, err = video.HLSPlaylist(r.Context(), fullPath, rendition)
+		}
+		if err != nil {
+			log.Printf("Error building HLS playlist: %v", err)
+			pathError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, playlist)
+		return
+	}
+
+	var n int
+	if _, err := fmt.Sscanf(name, "segment-%d.ts", &n); err != nil || name != fmt.Sprintf("segment-%d.ts", n) || rendition == "" {
+		http.NotFound(w, r)
+		return
+	}
+	segmentPath, err := video.HLSSegment(r.Context(), fullPath, rendition, n)
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("Error serving HLS segment: %v", err)
+			pathError(w, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, segmentPath)
+}
+
+func handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(indexer.GetStatus())
+}
+
+// shuttingDown is closed when the server stops, to end event streams which
+// would otherwise keep the server waiting
+var shuttingDown = make(chan struct{})
+
+// handleEvents streams folder changes to the browser as Server-Sent Events.
+// Each "folder-changed" event carries the listing path of the changed folder.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	changes := events.Subscribe()
+	defer events.Unsubscribe(changes)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable buffering in nginx
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	// Comments keep the connection open through proxies
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case path := <-changes:
+			data, _ := json.Marshal(struct {
+				Path string `json:"path"`
+			}{Path: path})
+			fmt.Fprintf(w, "event: folder-changed\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
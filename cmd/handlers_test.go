@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/search"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/video/videotest"
+)
+
+// testServer serves the router on a temporary library, with ffmpeg replaced
+// by a fake. Redirects are not followed so they can be checked.
+type testServer struct {
+	*httptest.Server
+	dir  string
+	fake *videotest.Fake
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	if err := loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newRouter(config.Get()))
+	t.Cleanup(srv.Close)
+	srv.Client().CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &testServer{Server: srv, dir: dir, fake: fake}
+}
+
+// get requests path with optional headers as name, value pairs
+func (s *testServer) get(t *testing.T, path string, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	return s.do(t, "GET", path, headers...)
+}
+
+func (s *testServer) do(t *testing.T, method, path string, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+// decode parses a JSON response, failing on other content types
+func decode(t *testing.T, resp *http.Response, body []byte) map[string]any {
+	t.Helper()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", ct)
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(body, &obj); err != nil {
+		t.Fatalf("invalid JSON %q: %v", body, err)
+	}
+	return obj
+}
+
+// checkSchema fails if obj misses a key or has a value of another JSON type:
+// "string", "number", "bool", "array" or "object"
+func checkSchema(t *testing.T, name string, obj map[string]any, schema map[string]string) {
+	t.Helper()
+	for key, want := range schema {
+		value, ok := obj[key]
+		if !ok {
+			t.Errorf("%s: missing %q in %v", name, key, obj)
+			continue
+		}
+		var got string
+		switch value.(type) {
+		case string:
+			got = "string"
+		case float64:
+			got = "number"
+		case bool:
+			got = "bool"
+		case []any:
+			got = "array"
+		case map[string]any:
+			got = "object"
+		}
+		if got != want {
+			t.Errorf("%s: %q is %T, want %s", name, key, value, want)
+		}
+	}
+}
+
+func query(path string) string {
+	return url.QueryEscape(path)
+}
+
+func TestBrowseAPI(t *testing.T) {
+	s := newTestServer(t)
+	videotest.WriteFile(t, s.dir, "talks/keynote.mp4", 100)
+	videotest.WriteFile(t, s.dir, "talks/notes.txt", 10)
+	videotest.WriteFile(t, s.dir, "talks/2024/demo.mkv", 100)
+	s.fake.Infos["keynote.mp4"] = &video.VideoInfo{Duration: 600, Width: 1280, Height: 720}
+
+	resp, body := s.get(t, "/api/browse?path=talks")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	listing := decode(t, resp, body)
+	checkSchema(t, "listing", listing, map[string]string{"path": "string", "items": "array"})
+	items := listing["items"].([]any)
+	if len(items) != 2 {
+		t.Fatalf("items = %v, want the folder and the video", items)
+	}
+	folder, keynote := items[0].(map[string]any), items[1].(map[string]any)
+	checkSchema(t, "folder", folder, map[string]string{"name": "string", "path": "string", "type": "string"})
+	checkSchema(t, "video", keynote, map[string]string{
+		"name": "string", "path": "string", "type": "string", "size": "number",
+		"duration": "number", "width": "number", "height": "number", "updatedAt": "string",
+	})
+	if folder["path"] != "talks/2024" || folder["type"] != "directory" {
+		t.Errorf("folder = %v", folder)
+	}
+	if keynote["path"] != "talks/keynote.mp4" || keynote["duration"] != 600.0 {
+		t.Errorf("video = %v", keynote)
+	}
+	if _, ok := keynote["fullPath"]; ok || strings.Contains(string(body), s.dir) {
+		t.Errorf("listing exposes filesystem paths: %s", body)
+	}
+
+	resp, body = s.get(t, "/api/browse?sort=nope")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid sort: status = %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestBrowseHTML(t *testing.T) {
+	s := newTestServer(t)
+	videotest.WriteFile(t, s.dir, "a b&c/run_1.mp4", 10)
+	videotest.WriteFile(t, s.dir, `<img src=x onerror=alert(1)>.mp4`, 10)
+	videotest.WriteFile(t, s.dir, `it's "quoted".mp4`, 10)
+
+	resp, body := s.get(t, "/api/browse/html?path=/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	html := string(body)
+	for _, want := range []string{
+		`<ul class="file-list" data-path="/">`,
+		`hx-get="/api/browse/html?path=a&#43;b%26c"`,
+		`data-video="&lt;img src=x onerror=alert(1)&gt;.mp4"`,
+		`data-video="it&#39;s &#34;quoted&#34;.mp4"`,
+		`src="/api/video/thumbnail?path=it%27s%20%22quoted%22.mp4"`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("listing lacks %s:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, "<img src=x") {
+		t.Errorf("file name is not escaped:\n%s", html)
+	}
+
+	// Sub folders link to their parent
+	resp, body = s.get(t, "/api/browse/html?path="+query("a b&c"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	for _, want := range []string{`data-path="a b&amp;c"`, `hx-get="/api/browse/html?path=%2F"`, `data-video="a b&amp;c/run_1.mp4"`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("sub folder listing lacks %s:\n%s", want, body)
+		}
+	}
+
+	resp, _ = s.get(t, "/api/browse/html?path=a.mp4")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("listing a file: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestBadPaths(t *testing.T) {
+	s := newTestServer(t)
+	videotest.WriteFile(t, s.dir, "clip.mp4", 100)
+	videotest.WriteFile(t, s.dir, ".private/clip.mp4", 100)
+	outside := t.TempDir()
+	secret := videotest.WriteFile(t, outside, "secret.mp4", 100)
+	if err := os.Symlink(secret, filepath.Join(s.dir, "link.mp4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(s.dir, "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoints := []string{"/api/browse", "/api/browse/html", "/api/video", "/api/video/stream", "/api/video/thumbnail", "/api/video/subtitle?lang=eng&"}
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"../../../etc/passwd", http.StatusNotFound}, // Cleaned to a path inside the library
+		{"/etc/passwd", http.StatusNotFound},
+		{"..%2f..%2fsecret.mp4", http.StatusNotFound},
+		{".private/clip.mp4", http.StatusBadRequest},
+		{"link.mp4", http.StatusBadRequest},
+		{"elsewhere/secret.mp4", http.StatusBadRequest},
+		{"elsewhere", http.StatusBadRequest},
+	}
+	for _, endpoint := range endpoints {
+		for _, test := range tests {
+			sep := "?"
+			if strings.HasSuffix(endpoint, "&") {
+				sep = ""
+			}
+			target := endpoint + sep + "path=" + test.path
+			resp, body := s.get(t, target)
+			// A listing of a file is refused before the path is resolved
+			if strings.HasPrefix(endpoint, "/api/browse/html") && filepath.Ext(test.path) != "" {
+				if resp.StatusCode != http.StatusBadRequest {
+					t.Errorf("%s: status = %d, want 400", target, resp.StatusCode)
+				}
+				continue
+			}
+			if resp.StatusCode != test.status {
+				t.Errorf("%s: status = %d, want %d", target, resp.StatusCode, test.status)
+			}
+			if bytes.Contains(body, []byte(outside)) || bytes.Contains(body, []byte(s.dir)) {
+				t.Errorf("%s: response exposes a filesystem path: %s", target, body)
+			}
+		}
+	}
+
+	for _, endpoint := range []string{"/api/video", "/api/video/stream", "/api/video/thumbnail", "/api/video/subtitle"} {
+		if resp, _ := s.get(t, endpoint); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s without path: status = %d, want 400", endpoint, resp.StatusCode)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	s := newTestServer(t)
+	path := videotest.WriteFile(t, s.dir, "talks/clip.mp4", 10000)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/api/video/stream?path=" + query("talks/clip.mp4")
+
+	resp, body := s.get(t, target)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("full request: status = %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "video/mp4" {
+		t.Errorf("Content-Type = %q, want video/mp4", ct)
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "10000" {
+		t.Errorf("Content-Length = %q, want 10000", cl)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", cc)
+	}
+	if resp, body := s.get(t, target, "If-None-Match", resp.Header.Get("ETag")); resp.StatusCode != http.StatusNotModified || len(body) > 0 {
+		t.Errorf("revalidation: status = %d, want 304", resp.StatusCode)
+	}
+
+	ranges := []struct {
+		header       string
+		contentRange string
+		start, end   int
+	}{
+		{"bytes=0-0", "bytes 0-0/10000", 0, 0},
+		{"bytes=0-1023", "bytes 0-1023/10000", 0, 1023},
+		{"bytes=5000-", "bytes 5000-9999/10000", 5000, 9999},
+		{"bytes=9999-9999", "bytes 9999-9999/10000", 9999, 9999},
+		{"bytes=-100", "bytes 9900-9999/10000", 9900, 9999},
+		{"bytes=9000-20000", "bytes 9000-9999/10000", 9000, 9999},
+	}
+	for _, r := range ranges {
+		resp, body := s.get(t, target, "Range", r.header)
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Errorf("%s: status = %d, want 206", r.header, resp.StatusCode)
+			continue
+		}
+		if got := resp.Header.Get("Content-Range"); got != r.contentRange {
+			t.Errorf("%s: Content-Range = %q, want %q", r.header, got, r.contentRange)
+		}
+		if !bytes.Equal(body, data[r.start:r.end+1]) {
+			t.Errorf("%s: got %d bytes, want bytes %d-%d of the file", r.header, len(body), r.start, r.end)
+		}
+	}
+
+	resp, _ = s.get(t, target, "Range", "bytes=10000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Content-Range") != "bytes */10000" {
+		t.Errorf("unsatisfiable range: status = %d, Content-Range = %q", resp.StatusCode, resp.Header.Get("Content-Range"))
+	}
+	if resp, body := s.do(t, "HEAD", target); resp.StatusCode != http.StatusOK || len(body) > 0 || resp.ContentLength != 10000 {
+		t.Errorf("HEAD: status = %d, Content-Length = %d, %d bytes body", resp.StatusCode, resp.ContentLength, len(body))
+	}
+
+	videotest.WriteFile(t, s.dir, "notes.txt", 10)
+	for path, want := range map[string]int{
+		"notes.txt":        http.StatusNotFound,
+		"talks":            http.StatusNotFound,
+		"missing.mp4":      http.StatusNotFound,
+		"../outside.mp4":   http.StatusNotFound, // Cleaned to a path inside the library
+		".hidden/clip.mp4": http.StatusBadRequest,
+	} {
+		if resp, _ := s.get(t, "/api/video/stream?path="+query(path)); resp.StatusCode != want {
+			t.Errorf("stream of %s: status = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestVideoAPI(t *testing.T) {
+	s := newTestServer(t)
+	videotest.WriteFile(t, s.dir, "film.mkv", 100)
+	s.fake.Infos["film.mkv"] = &video.VideoInfo{
+		Duration: 5400, Width: 1920, Height: 800, Bitrate: 6000000, Format: "matroska,webm",
+		Subtitles: []video.SubtitleInfo{{Language: "fre", StreamIndex: 2, Codec: "subrip"}},
+	}
+
+	resp, body := s.get(t, "/api/video?path=film.mkv")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	obj := decode(t, resp, body)
+	checkSchema(t, "video", obj, map[string]string{"path": "string", "type": "string", "playback": "string", "info": "object"})
+	info := obj["info"].(map[string]any)
+	checkSchema(t, "info", info, map[string]string{
+		"duration": "number", "width": "number", "height": "number",
+		"bitrate": "number", "format": "string", "subtitles": "array",
+	})
+	sub := info["subtitles"].([]any)[0].(map[string]any)
+	checkSchema(t, "subtitle", sub, map[string]string{"language": "string", "streamIndex": "number", "codec": "string"})
+	if obj["path"] != "film.mkv" || obj["playback"] != "hls" || info["height"] != 800.0 || sub["language"] != "fre" {
+		t.Errorf("video = %s", body)
+	}
+
+	if resp, _ := s.get(t, "/api/video?path=missing.mkv"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing video: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestHLS(t *testing.T) {
+	s := newTestServer(t)
+	videotest.WriteFile(t, s.dir, "films/été.mkv", 100)
+	s.fake.Infos["été.mkv"] = &video.VideoInfo{Duration: 10, Width: 1280, Height: 720, Bitrate: 3_000_000, VideoCodec: "hevc"}
+	base := "/api/video/hls/films/" + url.PathEscape("été.mkv")
+
+	resp, body := s.get(t, base+"/index.m3u8")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !bytes.Contains(body, []byte("RESOLUTION=1280x720\n720p/index.m3u8\n")) ||
+		!bytes.Contains(body, []byte("RESOLUTION=854x480\n480p/index.m3u8\n")) {
+		t.Errorf("master playlist = %s", body)
+	}
+
+	resp, body = s.get(t, base+"/480p/index.m3u8")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("rendition playlist: status = %d: %s", resp.StatusCode, body)
+	}
+	if !bytes.Contains(body, []byte("#EXTINF:4.000,\nsegment-1.ts\n#EXT-X-ENDLIST")) {
+		t.Errorf("rendition playlist = %s", body)
+	}
+
+	resp, body = s.get(t, base+"/480p/segment-1.ts")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("segment: status = %d: %s", resp.StatusCode, body)
+	}
+	opts := video.SegmentOptions{Start: 6 * time.Second, Duration: 4 * time.Second, Height: 480, VideoBitrate: 1_200_000}
+	if want := videotest.SegmentOutput("été.mkv", opts); string(body) != want {
+		t.Errorf("segment = %q, want %q", body, want)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "video/mp2t" {
+		t.Errorf("segment Content-Type = %q", ct)
+	}
+
+	for _, target := range []string{
+		base + "/480p/segment-2.ts",
+		base + "/480p/segment-01.ts",
+		base + "/480p/other.txt",
+		base + "/segment-0.ts", // Segments belong to a rendition
+		base + "/1080p/index.m3u8",
+		base + "/1080p/segment-0.ts",
+		"/api/video/hls/films/missing.mkv/index.m3u8",
+		"/api/video/hls/films/index.m3u8",
+	} {
+		if resp, _ := s.get(t, target); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", target, resp.StatusCode)
+		}
+	}
+	videotest.WriteFile(t, s.dir, ".private/clip.mkv", 100)
+	if resp, _ := s.get(t, "/api/video/hls/.private/clip.mkv/index.m3u8"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("hidden video: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	s := newTestServer(t)
+	videotest.WriteFile(t, s.dir, "clip.mp4", 100)
+	videotest.WriteFile(t, s.dir, "broken.mp4", 100)
+	s.fake.Errors["broken.mp4"] = io.ErrUnexpectedEOF
+
+	resp, body := s.get(t, "/api/video/thumbnail?path=clip.mp4")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Content-Type = %q, want image/jpeg", ct)
+	}
+	if !bytes.HasPrefix(body, []byte{0xff, 0xd8}) {
+		t.Error("thumbnail is not a JPEG")
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("thumbnail has no ETag")
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", cc)
+	}
+	if resp, _ := s.get(t, "/api/video/thumbnail?path=clip.mp4", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation: status = %d, want 304", resp.StatusCode)
+	}
+	if n := s.fake.Calls("Thumbnail"); n != 1 {
+		t.Errorf("thumbnail generated %d times, want 1", n)
+	}
+
+	resp, _ = s.get(t, "/api/video/thumbnail?path=broken.mp4")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/static/img/no-preview.jpg" {
+		t.Errorf("broken video: status = %d to %q, want the no preview image", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestSubtitle(t *testing.T) {
+	s := newTestServer(t)
+	videotest.WriteFile(t, s.dir, "film.mkv", 100)
+	s.fake.Infos["film.mkv"] = &video.VideoInfo{
+		Subtitles: []video.SubtitleInfo{{Language: "eng", StreamIndex: 3, Codec: "subrip"}},
+	}
+
+	resp, body := s.get(t, "/api/video/subtitle?path=film.mkv&lang=eng")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/subtitles/") || !strings.HasSuffix(location, "_eng.vtt") {
+		t.Fatalf("redirected to %q, want a file of /subtitles/", location)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "" {
+		t.Errorf("redirect Cache-Control = %q, the redirect must not be cached", cc)
+	}
+	resp, body = s.get(t, location)
+	if resp.StatusCode != http.StatusOK || !bytes.HasPrefix(body, []byte("WEBVTT")) || !bytes.Contains(body, []byte("Stream 3")) {
+		t.Errorf("subtitle file: status = %d: %s", resp.StatusCode, body)
+	}
+	// Subtitle files are named after the video size and mtime
+	if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("subtitle file Cache-Control = %q, want immutable", cc)
+	}
+	if resp, _ := s.get(t, "/subtitles/missing_eng.vtt"); resp.StatusCode != http.StatusNotFound || resp.Header.Get("Cache-Control") != "" {
+		t.Errorf("missing subtitle file: status = %d, Cache-Control = %q", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+
+	if resp, _ := s.get(t, "/api/video/subtitle?path=film.mkv&lang=ger"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing language: status = %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := s.get(t, "/api/video/subtitle?path=film.mkv"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("no language: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestServer(t)
+	search.Add(search.Document{Path: "talks/keynote.mp4", Name: "keynote.mp4", Folder: "talks", Duration: 65})
+	t.Cleanup(func() { search.Remove("talks/keynote.mp4") })
+
+	resp, body := s.get(t, "/api/search?q=keynote")
+	obj := decode(t, resp, body)
+	checkSchema(t, "search", obj, map[string]string{"query": "string", "items": "array"})
+	items := obj["items"].([]any)
+	if len(items) != 1 {
+		t.Fatalf("items = %v, want keynote", items)
+	}
+	checkSchema(t, "result", items[0].(map[string]any), map[string]string{
+		"path": "string", "name": "string", "folder": "string", "duration": "number", "score": "number",
+	})
+
+	resp, body = s.get(t, "/api/search?q=nothing")
+	if obj := decode(t, resp, body); len(obj["items"].([]any)) != 0 {
+		t.Errorf("search without match = %s, want empty items", body)
+	}
+
+	_, body = s.get(t, "/api/search/html?q=keynote")
+	for _, want := range []string{`data-video="talks/keynote.mp4"`, `<small class="folder">talks</small>`, "01:05"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("search results lack %s:\n%s", want, body)
+		}
+	}
+
+	resp, _ = s.get(t, "/api/search/html?q=")
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("empty search: status = %d, want a redirect to the root listing", resp.StatusCode)
+	}
+}
+
+func TestStaticAndAdmin(t *testing.T) {
+	s := newTestServer(t)
+
+	resp, _ := s.get(t, "/")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/static/" {
+		t.Errorf("/: status = %d to %q, want /static/", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp, body := s.get(t, "/static/")
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte("<html")) {
+		t.Errorf("/static/: status = %d", resp.StatusCode)
+	}
+	if resp, _ := s.get(t, "/static/missing.js"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing static file: status = %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := s.get(t, "/nowhere"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown route: status = %d, want 404", resp.StatusCode)
+	}
+
+	resp, body = s.get(t, "/api/admin/jobs")
+	checkSchema(t, "jobs", decode(t, resp, body), map[string]string{
+		"scanning": "bool", "videos": "number", "queued": "number", "pool": "object",
+	})
+
+	resp, _ = s.get(t, "/api/admin/reload")
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST" {
+		t.Errorf("GET reload: status = %d, Allow = %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	s := newTestServer(t)
+	reloadAs := func(headers ...string) (int, string) {
+		resp, body := s.do(t, "POST", "/api/admin/reload", headers...)
+		return resp.StatusCode, string(body)
+	}
+
+	// Pages of other sites can't post to it
+	if status, _ := reloadAs("Sec-Fetch-Site", "cross-site"); status != http.StatusForbidden {
+		t.Errorf("cross-site reload: status = %d, want 403", status)
+	}
+	if status, _ := reloadAs("Origin", "http://example.com"); status != http.StatusForbidden {
+		t.Errorf("reload from another origin: status = %d, want 403", status)
+	}
+
+	// Without a token, only from localhost
+	req := httptest.NewRequest("POST", "/api/admin/reload", nil)
+	req.RemoteAddr = "192.0.2.1:40000"
+	rec := httptest.NewRecorder()
+	handleAdminReload(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("reload from another host: status = %d, want 403", rec.Code)
+	}
+
+	cfg := *config.Get()
+	cfg.AdminToken = "secret"
+	config.Set(&cfg)
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		if status, _ := reloadAs("Authorization", auth); status != http.StatusForbidden {
+			t.Errorf("reload with Authorization %q: status = %d, want 403", auth, status)
+		}
+	}
+	// An invalid configuration is reported without details
+	args := os.Args
+	os.Args = []string{"wallplayer", "--port", "eighty"}
+	t.Cleanup(func() { os.Args = args })
+	status, body := reloadAs("Authorization", "Bearer secret")
+	if status != http.StatusInternalServerError || body != "Reload failed, see the server log\n" {
+		t.Errorf("failed reload: status = %d, body = %q", status, body)
+	}
+}
@@ -1,50 +1,162 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"wallplayer/pkg/browse"
 	"wallplayer/pkg/config"
+	"wallplayer/pkg/events"
+	"wallplayer/pkg/indexer"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/watcher"
 )
 
 // Les handlers sont dans handlers.go
 
 func main() {
-	port := fmt.Sprintf(":%d", config.Port)
+	cfg, printOnly, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if printOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+	config.Set(cfg)
+
+	port := fmt.Sprintf(":%d", cfg.Port)
 	// Initialize videos directory
-	if err := browse.Init(); err != nil {
+	if err := browse.Init(cfg); err != nil {
 		log.Fatalf("Failed to initialize videos directory: %v", err)
 	}
-	log.Printf("Videos directory: %s", browse.BaseDir)
+	logLibraries()
+	log.Printf("Data directory: %s", cfg.DataDir)
 
 	// Create generated directories
 	if err := config.EnsureDirectories(); err != nil {
-		log.Fatalf("Failed to create required directories: %v", err)
+		log.Fatalf("Failed to prepare data directory: %v", err)
+	}
+
+	if err := loadTemplates(); err != nil {
+		log.Fatalf("Failed to load templates: %v", err)
+	}
+
+	// Pre-generate metadata and thumbnails, and clean generated files in the background
+	indexer.Start()
+
+	// Keep caches in sync with changes in the libraries
+	startWatchers()
+	// Reload the configuration on SIGHUP
+	handleSignals()
+
+	server := &http.Server{
+		Addr:    port,
+		Handler: newRouter(cfg),
+		// No WriteTimeout: a stream lasts as long as the video
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
 	}
+	server.RegisterOnShutdown(func() { close(shuttingDown) })
+
+	// Stop on SIGTERM (docker stop, systemd) and SIGINT (Ctrl-C)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	// Dev mode detection
-	devMode := os.Getenv("DEV") == "1"
+	go func() {
+		log.Println("Starting server on " + port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop() // A second signal kills the process
+	shutdown(server)
+}
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// newRouter returns the handler of every route
+func newRouter(cfg *config.Config) http.Handler {
+	mux := http.NewServeMux()
 
 	// Configure static file serving based on mode
-	setupStaticHandlers(devMode)
+	setupStaticHandlers(mux, cfg.Dev)
 
 	// Handle generated directories
-	http.Handle("/thumbnails/", http.StripPrefix("/thumbnails/", http.FileServer(http.Dir(config.ThumbnailsDir))))
-	http.Handle("/subtitles/", http.StripPrefix("/subtitles/", http.FileServer(http.Dir(config.SubtitlesDir))))
+	mux.Handle("/thumbnails/", immutable(http.StripPrefix("/thumbnails/", http.FileServer(http.Dir(cfg.ThumbnailsDir())))))
+	mux.Handle("/subtitles/", immutable(http.StripPrefix("/subtitles/", http.FileServer(http.Dir(cfg.SubtitlesDir())))))
 
 	// API routes
-	http.HandleFunc("/api/browse", handleBrowseAPI)
-	http.HandleFunc("/api/browse/html", handleBrowseHTML)
-	http.HandleFunc("/api/video", handleVideoAPI)
-	http.HandleFunc("/api/video/stream", handleVideoStream)
-	http.HandleFunc("/api/video/thumbnail", handleVideoThumbnail)
-	http.HandleFunc("/api/video/subtitle", handleVideoSubtitle)
-
-	log.Println("Starting server on " + port)
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatal(err)
+	mux.HandleFunc("/api/browse", handleBrowseAPI)
+	mux.HandleFunc("/api/browse/html", handleBrowseHTML)
+	mux.HandleFunc("/api/search", handleSearchAPI)
+	mux.HandleFunc("/api/search/html", handleSearchHTML)
+	mux.HandleFunc("/api/video", handleVideoAPI)
+	mux.HandleFunc("/api/video/stream", handleVideoStream)
+	mux.HandleFunc("/api/video/thumbnail", handleVideoThumbnail)
+	mux.HandleFunc("/api/video/subtitle", handleVideoSubtitle)
+	mux.HandleFunc("/api/video/hls/", handleHLS)
+	mux.HandleFunc("/api/admin/jobs", handleAdminJobs)
+	mux.HandleFunc("/api/admin/reload", handleAdminReload)
+	mux.HandleFunc("/api/events", handleEvents)
+	return mux
+}
+
+// shutdown stops the server: requests in progress, and the ffmpeg jobs they
+// wait for, get the configured drain timeout to finish. Remaining jobs are
+// then killed, HLS encodings are stopped and the metadata cache is written to
+// disk.
+func shutdown(server *http.Server) {
+	timeout := config.Get().ShutdownTimeout
+	log.Printf("Shutting down, waiting up to %s for requests in progress", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Closing remaining connections: %v", err)
+		server.Close()
+	}
+	// Background jobs of the indexer and HLS prefetching
+	video.CancelJobs()
+	video.CloseHLSSessions(0)
+
+	if err := video.FlushCache(); err != nil {
+		log.Printf("Error saving metadata cache: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// logLibraries prints the videos directories in use
+func logLibraries() {
+	for _, lib := range browse.Libraries() {
+		if lib.Name == "" {
+			log.Printf("Videos directory: %s", lib.Dir)
+		} else {
+			log.Printf("Library %s: %s", lib.Name, lib.Dir)
+		}
+	}
+}
+
+// handleChange updates caches and notifies screens when a library changes
+func handleChange(ev watcher.Event) {
+	indexer.HandleChange(ev)
+	if ev.IsDir || browse.IsVideo(ev.Path) {
+		events.Publish(browse.ListingPath(ev.Path))
 	}
 }
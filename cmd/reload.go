@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"wallplayer/pkg/browse"
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/events"
+	"wallplayer/pkg/indexer"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/watcher"
+)
+
+var (
+	// reloadMu serializes reloads, and protects watchers
+	reloadMu sync.Mutex
+	watchers []*watcher.Watcher
+)
+
+// reload reads the configuration again, from the same file, environment and
+// flags as at startup. Settings are swapped at once, on error the current
+// configuration is kept. Streams being played are not interrupted: they
+// keep the file they opened.
+func reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	old := config.Get()
+	cfg, _, err := config.Load(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	// Only read at startup: the listener, the static files and the data
+	// directory holding caches in use
+	if cfg.Port != old.Port || cfg.Dev != old.Dev || cfg.DataDir != old.DataDir {
+		log.Printf("Reload: port, dev and data_dir changes need a restart")
+	}
+	cfg.Port, cfg.Dev, cfg.DataDir = old.Port, old.Dev, old.DataDir
+
+	if err := browse.Init(cfg); err != nil {
+		return err
+	}
+	config.Set(cfg)
+	video.ResizeJobs()
+	logLibraries()
+
+	if err := loadTemplates(); err != nil {
+		log.Printf("Reload: keeping current templates: %v", err)
+	}
+	startWatchersLocked()
+
+	// Libraries may have changed: index them and refresh the screens
+	go indexer.Scan()
+	events.Publish("/")
+	log.Printf("Configuration reloaded")
+	return nil
+}
+
+// startWatchers watches the libraries, read-only ones never change
+func startWatchers() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	startWatchersLocked()
+}
+
+// startWatchersLocked replaces the current watchers, reloadMu must be held
+func startWatchersLocked() {
+	for _, w := range watchers {
+		w.Close()
+	}
+	watchers = nil
+	if !config.Get().Watch {
+		return
+	}
+	for _, lib := range browse.Libraries() {
+		if lib.ReadOnly {
+			continue
+		}
+		w, err := watcher.New(lib.Dir, lib.HiddenFiles, handleChange)
+		if err != nil {
+			log.Printf("Filesystem watcher disabled for %s: %v", lib.Dir, err)
+			continue
+		}
+		watchers = append(watchers, w)
+	}
+}
+
+// handleSignals reloads the configuration on SIGHUP
+func handleSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("SIGHUP received, reloading configuration")
+			if err := reload(); err != nil {
+				log.Printf("Reload failed, keeping current configuration: %v", err)
+			}
+		}
+	}()
+}
+
+// crossOrigin refuses requests sent by the pages of other sites, like a
+// form posted to the reload endpoint from a page open on a screen
+var crossOrigin = http.NewCrossOriginProtection()
+
+// adminAllowed reports if r may change the state of the server: it must
+// carry ADMIN_TOKEN as a bearer token if set, else come from localhost
+func adminAllowed(r *http.Request) bool {
+	if token := config.Get().AdminToken; token != "" {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleAdminReload reloads the configuration, like SIGHUP. Errors are only
+// logged, they name files of the server.
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := crossOrigin.Check(r); err != nil || !adminAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := reload(); err != nil {
+		log.Printf("Reload failed, keeping current configuration: %v", err)
+		http.Error(w, "Reload failed, see the server log", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
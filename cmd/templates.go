@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"wallplayer/pkg/config"
+	"wallplayer/web"
+)
+
+// templates renders the HTML fragments returned to htmx, replaced on reload
+var templates atomic.Pointer[template.Template]
+
+// videoEntry is the data of the "video-item" template
+type videoEntry struct {
+	Path     string
+	Name     string
+	Folder   string
+	Duration float64
+}
+
+var templateFuncs = template.FuncMap{
+	"formatName":     formatName,
+	"formatDuration": formatDuration,
+	"video": func(path, name, folder string, duration float64) videoEntry {
+		return videoEntry{Path: path, Name: name, Folder: folder, Duration: duration}
+	},
+}
+
+// loadTemplates parses the embedded templates. A file with the same name in
+// the templates directory of the data directory is used instead of the
+// embedded one, so the markup can be customized without rebuilding.
+func loadTemplates() error {
+	names, err := fs.Glob(web.Templates, "templates/*.html")
+	if err != nil {
+		return err
+	}
+	tmpl := template.New("").Funcs(templateFuncs)
+	for _, name := range names {
+		base := filepath.Base(name)
+		data, err := os.ReadFile(filepath.Join(config.Get().TemplatesDir(), base))
+		if err == nil {
+			log.Printf("Using template override: %s", base)
+		} else if os.IsNotExist(err) {
+			data, err = web.Templates.ReadFile(name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read template %s: %w", base, err)
+		}
+		if _, err := tmpl.New(base).Parse(string(data)); err != nil {
+			return fmt.Errorf("failed to parse template %s: %w", base, err)
+		}
+	}
+	templates.Store(tmpl)
+	return nil
+}
+
+// formatDuration formats seconds as mm:ss, "⋯" while the duration is unknown
+func formatDuration(duration float64) string {
+	if duration <= 0 {
+		return "⋯"
+	}
+	return fmt.Sprintf("%02d:%02d", int(duration/60), int(duration)%60)
+}
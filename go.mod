@@ -2,4 +2,8 @@ module wallplayer
 
 go 1.25.1
 
-require github.com/vansante/go-ffprobe v1.1.0
+require (
+	github.com/vansante/go-ffprobe v1.1.0
+	golang.org/x/text v0.40.0
+	gopkg.in/yaml.v3 v3.0.1
+)
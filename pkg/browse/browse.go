@@ -1,16 +1,21 @@
 package browse
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/text/language"
+
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/safepath"
 	"wallplayer/pkg/video"
 )
 
@@ -21,79 +26,84 @@ const (
 var (
 	ErrInvalidPath = errors.New("invalid path: must be within Videos directory")
 	ErrNoVideosDir = errors.New("VIDEOS_DIR environment variable not set")
-	BaseDir        string
 )
 
-func Init() error {
-	// Get videos directory from environment
-	videosDir := os.Getenv("VIDEOS_DIR")
-	if videosDir == "" {
-		// Fallback to default if not set
-		workDir, err := os.Getwd()
-		if err != nil {
-			return fmt.Errorf("failed to get working directory: %w", err)
-		}
-		videosDir = filepath.Join(workDir, DefaultVideosDir)
-
-		// Create directory if it doesn't exist
-		if err := os.MkdirAll(videosDir, 0755); err != nil {
-			return fmt.Errorf("failed to create videos directory: %w", err)
-		}
+// Init reads the libraries from cfg. It is called again on reload: requests
+// already resolved, like streams being played, keep going with the files
+// they opened. Nothing changes if cfg is invalid.
+func Init(cfg *config.Config) error {
+	libs, err := loadLibraries(cfg)
+	if err != nil {
+		return err
 	}
+	// Both are checked when the configuration is loaded
+	symlinks, _ := safepath.ParsePolicy(cfg.Symlinks)
+	tag, _ := language.Parse(cfg.SortLocale)
 
-	// Make sure the directory exists
-	if _, err := os.Stat(videosDir); os.IsNotExist(err) {
-		return fmt.Errorf("videos directory does not exist: %s", videosDir)
-	}
+	current.Store(&state{libraries: libs, symlinks: symlinks, language: tag})
+	return nil
+}
 
-	// Get absolute path
-	absPath, err := filepath.Abs(videosDir)
-	if err != nil {
-		return fmt.Errorf("failed to get absolute path for videos directory: %w", err)
+// ListingPath returns the path of the folder containing fullPath, in the
+// form used by the browse API, "/" for the root
+func ListingPath(fullPath string) string {
+	return CleanListingPath(path.Dir(RelPath(fullPath)))
+}
+
+// CleanListingPath normalizes a requested folder path, so "/talks/",
+// "talks" and "./talks" all give "talks"
+func CleanListingPath(path string) string {
+	path = strings.Trim(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+	if path == "" {
+		return "/"
 	}
+	return path
+}
 
-	BaseDir = absPath
-	return nil
+// VideosIn walks dir, inside a library, and returns the full path of every
+// video. Hidden files and directories are skipped like in List. Linked
+// videos allowed by the symlink policy are returned, linked folders are not walked.
+func VideosIn(dir string) ([]string, error) {
+	lib := libraryOf(dir)
+	if lib == nil {
+		return nil, ErrInvalidPath
+	}
+	var videos []string
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && !lib.visible(entry.Name()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() && lib.isVideo(entry.Name()) && allowed(path, entry) {
+			videos = append(videos, path)
+		}
+		return nil
+	})
+	return videos, err
 }
 
 type Item struct {
 	Name      string  `json:"name"`
-	Path      string  `json:"path"` // Path relative to BaseDir
+	Path      string  `json:"path"` // Path used by the API, see RelPath
 	FullPath  string  `json:"-"`    // Full filesystem path (not exposed in API)
 	Type      string  `json:"type"` // "directory" or "video"
 	Size      int64   `json:"size,omitempty"`
 	Duration  float64 `json:"duration,omitempty"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
 	UpdatedAt string  `json:"updatedAt,omitempty"`
-}
-
-func sanitizePath(path string) (string, error) {
-	log.Printf("sanitizePath: input path: %q", path)
-
-	// If path is empty or root, use base dir
-	if path == "" || path == "/" {
-		log.Printf("sanitizePath: using BaseDir: %q", BaseDir)
-		return BaseDir, nil
-	}
-
-	// Clean the path to resolve any ".." or "." components
-	cleanPath := filepath.Join(BaseDir, filepath.Clean(path))
-	log.Printf("sanitizePath: cleaned path: %q", cleanPath)
 
-	// Get absolute path
-	absPath, err := filepath.Abs(cleanPath)
-	if err != nil {
-		return "", ErrInvalidPath
-	}
-
-	// Check if the path is within BaseDir
-	if !strings.HasPrefix(absPath, BaseDir) {
-		return "", ErrInvalidPath
-	}
-
-	return absPath, nil
+	ModTime time.Time `json:"-"` // Used for sorting and filtering, UpdatedAt in API
 }
 
-func List(requestedPath string) ([]Item, error) {
+// List returns the directories and videos of a folder, sorted and filtered with
+// opts. Videos are probed with ctx, those not probed before it ends have no duration.
+func List(ctx context.Context, requestedPath string, opts Options) ([]Item, error) {
 	type workItem struct {
 		fullPath string
 		info     os.FileInfo
@@ -103,14 +113,18 @@ func List(requestedPath string) ([]Item, error) {
 
 	log.Printf("List: requested path: %q", requestedPath)
 
-	// Sanitize and validate the path
-	path, err := sanitizePath(requestedPath)
+	if named() && CleanListingPath(requestedPath) == "/" {
+		return listLibraries(opts), nil
+	}
+
+	// Resolve and validate the path
+	lib, path, err := resolve(requestedPath)
 	if err != nil {
-		log.Printf("List: sanitizePath error: %v", err)
+		log.Printf("List: Resolve error: %v", err)
 		return nil, err
 	}
 
-	log.Printf("List: sanitized path: %q", path)
+	log.Printf("List: resolved path: %q", path)
 
 	// Check if path is a directory
 	info, err := os.Stat(path)
@@ -138,35 +152,37 @@ func List(requestedPath string) ([]Item, error) {
 	// Premier passage : collecter les dossiers et préparer les vidéos
 	for _, entry := range entries {
 		// Skip hidden files
-		if entry.Name()[0] == '.' {
+		if !lib.visible(entry.Name()) {
 			continue
 		}
 
-		info, err := entry.Info()
-		if err != nil {
+		fullPath := filepath.Join(path, entry.Name())
+		if !allowed(fullPath, entry) {
 			continue
 		}
-
-		fullPath := filepath.Join(path, entry.Name())
-		// Create path relative to BaseDir for API response
-		relPath, err := filepath.Rel(BaseDir, fullPath)
+		// Follow allowed links, a link to a folder is listed as a folder
+		info, err := os.Stat(fullPath)
 		if err != nil {
 			continue
 		}
 
-		if entry.IsDir() {
+		// Create path for API response
+		relPath := RelPath(fullPath)
+
+		if info.IsDir() {
 			items = append(items, Item{
 				Name:      entry.Name(),
 				Path:      relPath,
 				FullPath:  fullPath,
 				Type:      "directory",
 				UpdatedAt: info.ModTime().Format(time.RFC3339),
+				ModTime:   info.ModTime(),
 			})
 			continue
 		}
 
 		// Collecter les vidéos pour traitement asynchrone
-		if video.IsVideo(entry.Name()) {
+		if lib.isVideo(entry.Name()) {
 			videoItems = append(videoItems, workItem{
 				fullPath: fullPath,
 				info:     info,
@@ -176,7 +192,8 @@ func List(requestedPath string) ([]Item, error) {
 		}
 	}
 
-	// Traiter les vidéos en parallèle
+	// Traiter les vidéos en parallèle, le nombre de ffprobe simultanés
+	// est limité par la file de jobs du package video
 	resultChan := make(chan Item, len(videoItems))
 	for _, item := range videoItems {
 		wg.Add(1)
@@ -184,21 +201,21 @@ func List(requestedPath string) ([]Item, error) {
 			defer wg.Done()
 
 			// Récupérer les infos de la vidéo
-			videoInfo, _ := video.GetInfo(wi.fullPath)
-			duration := float64(0)
-			if videoInfo != nil {
-				duration = videoInfo.Duration
-			}
-
-			resultChan <- Item{
+			item := Item{
 				Name:      wi.name,
 				Path:      wi.relPath,
 				FullPath:  wi.fullPath,
 				Type:      "video",
 				Size:      wi.info.Size(),
-				Duration:  duration,
 				UpdatedAt: wi.info.ModTime().Format(time.RFC3339),
+				ModTime:   wi.info.ModTime(),
+			}
+			if videoInfo, _ := video.GetInfo(ctx, wi.fullPath); videoInfo != nil {
+				item.Duration = videoInfo.Duration
+				item.Width = videoInfo.Width
+				item.Height = videoInfo.Height
 			}
+			resultChan <- item
 		}(item)
 	}
 
@@ -210,20 +227,37 @@ func List(requestedPath string) ([]Item, error) {
 
 	// Collecter les résultats
 	for item := range resultChan {
-		items = append(items, item)
-	}
-
-	// Sort items by type (directories first) then by name
-	sort.Slice(items, func(i, j int) bool {
-		// If types are different, directories come first
-		if items[i].Type != items[j].Type {
-			return items[i].Type == "directory"
+		if !opts.filtered(item) {
+			items = append(items, item)
 		}
-		// If types are the same, sort by name
-		return strings.ToLower(items[i].Name) < strings.ToLower(items[j].Name)
-	})
+	}
 
+	sortItems(items, opts)
 	return items, nil
 }
 
+// listLibraries returns the root folder when libraries are named: one
+// directory per library
+func listLibraries(opts Options) []Item {
+	libraries := Libraries()
+	items := make([]Item, 0, len(libraries))
+	for _, lib := range libraries {
+		info, err := os.Stat(lib.Dir)
+		if err != nil {
+			log.Printf("List: library %s: %v", lib.Name, err)
+			continue
+		}
+		items = append(items, Item{
+			Name:      lib.Name,
+			Path:      lib.Name,
+			FullPath:  lib.Dir,
+			Type:      "directory",
+			UpdatedAt: info.ModTime().Format(time.RFC3339),
+			ModTime:   info.ModTime(),
+		})
+	}
+	sortItems(items, opts)
+	return items
+}
+
 //videoExtensions déplacé dans le package player
@@ -0,0 +1,119 @@
+package browse_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"wallplayer/pkg/browse"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/video/videotest"
+)
+
+func TestList(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	videotest.WriteFile(t, dir, "run_10.mp4", 10)
+	videotest.WriteFile(t, dir, "run_2.mkv", 20)
+	videotest.WriteFile(t, dir, "notes.txt", 30)
+	videotest.WriteFile(t, dir, ".hidden.mp4", 40)
+	videotest.WriteFile(t, dir, "talks/keynote.webm", 50)
+	fake.Infos["run_2.mkv"] = &video.VideoInfo{Duration: 12, Width: 1280, Height: 720}
+
+	items, err := browse.List(t.Context(), "/", browse.Options{Sort: browse.SortNatural})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+	want := []string{"talks", "run_2.mkv", "run_10.mp4"}
+	if !slices.Equal(names, want) {
+		t.Fatalf("List = %v, want %v", names, want)
+	}
+
+	talks, run2, run10 := items[0], items[1], items[2]
+	if talks.Type != "directory" || talks.Path != "talks" {
+		t.Errorf("folder item = %+v", talks)
+	}
+	if run2.Type != "video" || run2.Path != "run_2.mkv" || run2.Size != 20 {
+		t.Errorf("video item = %+v", run2)
+	}
+	if run2.Duration != 12 || run2.Height != 720 {
+		t.Errorf("video item has duration %v and height %d, want the probed 12 and 720", run2.Duration, run2.Height)
+	}
+	if run10.Duration != videotest.DefaultInfo.Duration {
+		t.Errorf("video item has duration %v, want %v", run10.Duration, videotest.DefaultInfo.Duration)
+	}
+
+	items, err = browse.List(t.Context(), "talks", browse.Options{Sort: browse.SortName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != "talks/keynote.webm" {
+		t.Errorf("List(talks) = %+v, want keynote.webm", items)
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	videotest.WriteFile(t, dir, "short.mp4", 10)
+	videotest.WriteFile(t, dir, "long.mp4", 10)
+	fake.Infos["short.mp4"] = &video.VideoInfo{Duration: 30, Height: 480}
+	fake.Infos["long.mp4"] = &video.VideoInfo{Duration: 3600, Height: 1080}
+
+	items, err := browse.List(t.Context(), "/", browse.Options{Sort: browse.SortName, MinHeight: 720})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Name != "long.mp4" {
+		t.Errorf("List with minHeight 720 = %+v, want long.mp4", items)
+	}
+
+	items, err = browse.List(t.Context(), "/", browse.Options{Sort: browse.SortDuration, Desc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Name != "long.mp4" {
+		t.Errorf("List by duration = %+v, want long.mp4 first", items)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dir := videotest.Setup(t, videotest.New())
+	videotest.WriteFile(t, dir, "a/clip.mp4", 10)
+	outside := videotest.WriteFile(t, t.TempDir(), "secret.mp4", 10)
+	if err := os.Symlink(outside, filepath.Join(dir, "link.mp4")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		err  error
+	}{
+		{"a/clip.mp4", nil},
+		{"/a/clip.mp4", nil},
+		{"a/../a/clip.mp4", nil},
+		{"../secret.mp4", nil}, // Cleaned as a path of the root: missing, not outside
+		{"a/missing.mp4", nil},
+		{".hidden/clip.mp4", browse.ErrInvalidPath},
+		{"link.mp4", browse.ErrInvalidPath},
+	}
+	for _, test := range tests {
+		_, err := browse.Resolve(test.path)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Resolve(%q) = %v, want %v", test.path, err, test.err)
+		}
+	}
+}
+
+func TestListMissing(t *testing.T) {
+	videotest.Setup(t, videotest.New())
+	if _, err := browse.List(t.Context(), "nowhere", browse.Options{}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("List of a missing folder = %v, want ErrNotExist", err)
+	}
+}
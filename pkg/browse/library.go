@@ -0,0 +1,265 @@
+package browse
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/text/language"
+
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/safepath"
+	"wallplayer/pkg/video"
+)
+
+// A library is a videos directory. Without libraries in the configuration,
+// the videos directory is the only library and its content is shown at the
+// root, paths are relative to it. With libraries, each one is a folder of
+// the root named after the library, paths start with the library name:
+// "talks/2024/keynote.mp4".
+
+// Library is a videos directory served by the browser
+type Library struct {
+	Name        string // Empty for the videos directory when no library is configured
+	Dir         string // Absolute path
+	ReadOnly    bool   // Not watched
+	HiddenFiles bool   // Files and folders starting with a dot are listed
+
+	extensions map[string]bool // nil for video.IsVideo
+}
+
+// state holds everything Init reads from the configuration, it is swapped
+// as a whole so a reload never gives a mix of old and new settings
+type state struct {
+	libraries []*Library
+	symlinks  safepath.Policy
+	language  language.Tag
+}
+
+var current atomic.Pointer[state]
+
+func init() {
+	current.Store(&state{symlinks: safepath.FollowInside, language: language.Und})
+	video.RelPath = RelPath
+}
+
+// Libraries returns the libraries in configuration order
+func Libraries() []*Library {
+	return current.Load().libraries
+}
+
+// loadLibraries builds the libraries from the configuration
+func loadLibraries(cfg *config.Config) ([]*Library, error) {
+	if len(cfg.Libraries) == 0 {
+		dir, err := videosDir(cfg.VideosDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := config.CheckSeparate(cfg.DataDir, dir); err != nil {
+			return nil, err
+		}
+		return []*Library{{Dir: dir}}, nil
+	}
+	if cfg.VideosDir != "" {
+		log.Printf("Libraries are configured, videos directory %s is ignored", cfg.VideosDir)
+	}
+
+	libs := make([]*Library, 0, len(cfg.Libraries))
+	for _, lc := range cfg.Libraries {
+		info, err := os.Stat(lc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("library %s: %w", lc.Name, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("library %s: %s is not a directory", lc.Name, lc.Path)
+		}
+		dir, err := filepath.Abs(lc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("library %s: %w", lc.Name, err)
+		}
+		lib := &Library{
+			Name:        lc.Name,
+			Dir:         dir,
+			ReadOnly:    lc.ReadOnly,
+			HiddenFiles: lc.HiddenFiles,
+		}
+		if len(lc.Extensions) > 0 {
+			lib.extensions = make(map[string]bool)
+			for _, ext := range lc.Extensions {
+				lib.extensions[ext] = true
+			}
+		}
+		if err := config.CheckSeparate(cfg.DataDir, dir); err != nil {
+			return nil, fmt.Errorf("library %s: %w", lib.Name, err)
+		}
+		// Nested libraries would give two paths to the same video
+		for _, other := range libs {
+			if safepath.Within(other.Dir, dir) || safepath.Within(dir, other.Dir) {
+				return nil, fmt.Errorf("libraries %s and %s must not be inside each other", other.Name, lib.Name)
+			}
+		}
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
+
+// videosDir returns the absolute path of the videos directory, "videos" in
+// the working directory is created if no directory is configured
+func videosDir(dir string) (string, error) {
+	if dir == "" {
+		// Fallback to default if not set
+		workDir, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("failed to get working directory: %w", err)
+		}
+		dir = filepath.Join(workDir, DefaultVideosDir)
+
+		// Create directory if it doesn't exist
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create videos directory: %w", err)
+		}
+	}
+
+	// Make sure the directory exists
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return "", fmt.Errorf("videos directory does not exist: %s", dir)
+	}
+
+	// Get absolute path
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path for videos directory: %w", err)
+	}
+	return absPath, nil
+}
+
+// named reports if libraries are shown as folders of the root
+func named() bool {
+	libraries := Libraries()
+	return len(libraries) > 0 && libraries[0].Name != ""
+}
+
+// libraryOf returns the library containing a full path
+func libraryOf(fullPath string) *Library {
+	for _, lib := range Libraries() {
+		if safepath.Within(lib.Dir, fullPath) {
+			return lib
+		}
+	}
+	return nil
+}
+
+// split finds the library of a client path and returns the path relative to
+// it. With named libraries the root belongs to no library: lib is nil.
+func split(requested string) (lib *Library, rel string, err error) {
+	libraries := Libraries()
+	clean := CleanListingPath(requested)
+	if !named() {
+		if len(libraries) == 0 {
+			return nil, "", ErrInvalidPath
+		}
+		return libraries[0], strings.TrimPrefix(clean, "/"), nil
+	}
+	if clean == "/" {
+		return nil, "", nil
+	}
+	name, rel, _ := strings.Cut(clean, "/")
+	for _, lib := range libraries {
+		if lib.Name == name {
+			return lib, rel, nil
+		}
+	}
+	return nil, "", os.ErrNotExist
+}
+
+// RelPath returns the path of a file as used by the API: relative to its
+// library and prefixed with the library name, with forward slashes
+func RelPath(fullPath string) string {
+	lib := libraryOf(fullPath)
+	if lib == nil {
+		return fullPath
+	}
+	rel, err := filepath.Rel(lib.Dir, fullPath)
+	if err != nil {
+		return fullPath
+	}
+	rel = filepath.ToSlash(rel)
+	if lib.Name == "" {
+		return rel
+	}
+	return path.Join(lib.Name, rel)
+}
+
+// Resolve returns the filesystem path of a path received from a client.
+// Paths leaving their library, through ".." or through a symbolic link
+// refused by the SYMLINKS policy, or going through hidden files of a
+// library not showing them, give ErrInvalidPath.
+func Resolve(path string) (string, error) {
+	_, fullPath, err := resolve(path)
+	return fullPath, err
+}
+
+func resolve(requested string) (*Library, string, error) {
+	lib, rel, err := split(requested)
+	if err != nil {
+		return nil, "", err
+	}
+	if lib == nil {
+		// The root of named libraries is not a directory
+		return nil, "", ErrInvalidPath
+	}
+	if !lib.HiddenFiles && hidden(rel) {
+		log.Printf("Resolve: rejected hidden path %q", requested)
+		return nil, "", ErrInvalidPath
+	}
+	fullPath, err := safepath.Resolve(lib.Dir, rel, current.Load().symlinks)
+	if errors.Is(err, safepath.ErrOutside) || errors.Is(err, safepath.ErrSymlink) {
+		log.Printf("Resolve: rejected path %q: %v", requested, err)
+		return nil, "", ErrInvalidPath
+	}
+	return lib, fullPath, err
+}
+
+// hidden reports if a relative path goes through a file or folder starting with a dot
+func hidden(rel string) bool {
+	for _, name := range strings.Split(rel, "/") {
+		if strings.HasPrefix(name, ".") && name != "." {
+			return true
+		}
+	}
+	return false
+}
+
+// IsVideo reports if a file of a library is a video, using the extensions
+// allowed in that library
+func IsVideo(fullPath string) bool {
+	lib := libraryOf(fullPath)
+	return lib != nil && lib.isVideo(filepath.Base(fullPath))
+}
+
+func (lib *Library) isVideo(name string) bool {
+	if lib.extensions == nil {
+		return video.IsVideo(name)
+	}
+	return lib.extensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// visible reports if an entry of a library folder is listed
+func (lib *Library) visible(name string) bool {
+	return lib.HiddenFiles || name[0] != '.'
+}
+
+// allowed reports if a file found while walking a library can be served,
+// symbolic links are checked with the same policy as client paths
+func allowed(fullPath string, entry os.DirEntry) bool {
+	if entry.Type()&os.ModeSymlink == 0 {
+		return true
+	}
+	_, err := Resolve(RelPath(fullPath))
+	return err == nil
+}
@@ -0,0 +1,199 @@
+package browse
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/collate"
+
+	"wallplayer/pkg/config"
+)
+
+var ErrInvalidOption = errors.New("invalid listing option")
+
+// Sort keys accepted by the sort parameter
+const (
+	SortName     = "name"
+	SortNatural  = "natural"
+	SortModTime  = "mtime"
+	SortSize     = "size"
+	SortDuration = "duration"
+)
+
+// Options controls the order and the filtering of a listing.
+// Directories are never filtered and always come first.
+type Options struct {
+	Sort        string
+	Desc        bool
+	MinDuration float64   // seconds, 0 for no limit
+	MaxDuration float64   // seconds, 0 for no limit
+	MinHeight   int       // pixels, 0 for no limit
+	MaxHeight   int       // pixels, 0 for no limit
+	After       time.Time // Modified at or after, zero for no limit
+	Before      time.Time // Modified before, zero for no limit
+}
+
+// ParseOptions reads listing options from query parameters:
+//
+//	sort=name|natural|mtime|size|duration  order=asc|desc
+//	  natural is the default unless disabled in the configuration
+//	minDuration, maxDuration: seconds or duration ("90", "1m30s")
+//	minHeight, maxHeight: video height ("720", "720p")
+//	after, before: date ("2024-01-31") or RFC3339 time, before a date excludes that day
+func ParseOptions(query url.Values) (Options, error) {
+	opts := Options{Sort: SortName}
+	if config.Get().NaturalSort {
+		opts.Sort = SortNatural
+	}
+	var err error
+
+	if s := query.Get("sort"); s != "" {
+		switch s {
+		case SortName, SortNatural, SortModTime, SortSize, SortDuration:
+			opts.Sort = s
+		default:
+			return opts, invalidOption("sort", s)
+		}
+	}
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, invalidOption("order", order)
+	}
+
+	if opts.MinDuration, err = parseSeconds(query, "minDuration"); err != nil {
+		return opts, err
+	}
+	if opts.MaxDuration, err = parseSeconds(query, "maxDuration"); err != nil {
+		return opts, err
+	}
+	if opts.MinHeight, err = parseHeight(query, "minHeight"); err != nil {
+		return opts, err
+	}
+	if opts.MaxHeight, err = parseHeight(query, "maxHeight"); err != nil {
+		return opts, err
+	}
+	if opts.After, err = parseDate(query, "after", false); err != nil {
+		return opts, err
+	}
+	if opts.Before, err = parseDate(query, "before", true); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func invalidOption(name, value string) error {
+	return fmt.Errorf("%w: %s=%q", ErrInvalidOption, name, value)
+}
+
+func parseSeconds(query url.Values, name string) (float64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return seconds, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return d.Seconds(), nil
+	}
+	return 0, invalidOption(name, value)
+}
+
+func parseHeight(query url.Values, name string) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	height, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(value), "p"))
+	if err != nil || height < 0 {
+		return 0, invalidOption(name, value)
+	}
+	return height, nil
+}
+
+// parseDate accepts a date or an RFC3339 time. With endOfDay, a date means
+// the end of that day, so before=2024-01-31 includes the 31st.
+func parseDate(query url.Values, name string, endOfDay bool) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, invalidOption(name, value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// filtered reports if opts excludes a video
+func (opts Options) filtered(item Item) bool {
+	switch {
+	case opts.MinDuration > 0 && item.Duration < opts.MinDuration,
+		opts.MaxDuration > 0 && item.Duration > opts.MaxDuration,
+		opts.MinHeight > 0 && item.Height < opts.MinHeight,
+		opts.MaxHeight > 0 && item.Height > opts.MaxHeight,
+		!opts.After.IsZero() && item.ModTime.Before(opts.After),
+		!opts.Before.IsZero() && !item.ModTime.Before(opts.Before):
+		return true
+	}
+	return false
+}
+
+// sortItems orders items according to opts, directories first
+func sortItems(items []Item, opts Options) {
+	// Names are compared with the collation rules of the configured locale:
+	// accented letters sort with their base letter, case is ignored, and
+	// with natural order numbers are compared by value ("run_2" < "run_10")
+	collateOpts := []collate.Option{collate.IgnoreCase}
+	if opts.Sort == SortNatural {
+		collateOpts = append(collateOpts, collate.Numeric)
+	}
+	collator := collate.New(current.Load().language, collateOpts...)
+	nameLess := func(a, b string) bool {
+		if c := collator.CompareString(a, b); c != 0 {
+			return c < 0
+		}
+		return a < b
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		// If types are different, directories come first
+		if a.Type != b.Type {
+			return a.Type == "directory"
+		}
+		if opts.Desc {
+			a, b = b, a
+		}
+		switch opts.Sort {
+		case SortModTime:
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		case SortSize:
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case SortDuration:
+			if a.Duration != b.Duration {
+				return a.Duration < b.Duration
+			}
+		}
+		// Equal values, name and natural sort: sort by name
+		return nameLess(a.Name, b.Name)
+	})
+}
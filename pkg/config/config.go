@@ -1,42 +1,161 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"wallplayer/pkg/safepath"
 )
 
 const (
 	// Default values
-	DefaultPort         = 9999
-	DefaultVideosDir    = "videos"
-	DefaultGeneratedDir = "data"
+	DefaultPort            = 9999
+	DefaultVideosDir       = "videos"
+	DefaultGeneratedDir    = "data"
+	DefaultProbeTimeout    = 10 * time.Second
+	DefaultJobTimeout      = 2 * time.Minute
+	DefaultScanInterval    = 1 * time.Hour
+	DefaultThumbnailWidth  = 320
+	DefaultThumbnailSeek   = 10 * time.Second
+	DefaultCacheSaveDelay  = 5 * time.Second
+	DefaultShutdownTimeout = 10 * time.Second
+	DefaultMaxRemuxes      = 16
+	DefaultHLSIdleTimeout  = 10 * time.Minute
+	DefaultHLSMaxAge       = 7 * 24 * time.Hour
 )
 
-var (
-	// Paths
-	ThumbnailsDir = filepath.Join(DefaultGeneratedDir, "thumbnails")
-	SubtitlesDir  = filepath.Join(DefaultGeneratedDir, "subtitles")
+// Config holds every setting of the server. Values come from, by order of
+// precedence: command-line flags, environment variables, the configuration
+// file and defaults. See Load.
+type Config struct {
+	Port      int    `yaml:"port"`
+	VideosDir string `yaml:"videos_dir"` // Empty for "videos" in the working directory
+	Dev       bool   `yaml:"dev"`        // Serve static files from web/static
+	// Libraries replace VideosDir with several named videos directories,
+	// they can only be set in the configuration file
+	Libraries []Library `yaml:"libraries"`
+	// DataDir holds generated files: thumbnails, subtitles, cache.
+	// Relative paths are resolved against the working directory by Load.
+	DataDir string `yaml:"data_dir"`
 
-	// Runtime configuration
-	Port = getPort()
-)
+	// MaxJobs is the number of ffprobe/ffmpeg processes allowed to run at once
+	MaxJobs int `yaml:"max_jobs"`
+	// MaxRemuxes is the number of videos remuxed at once, outside of MaxJobs:
+	// a remux copies streams for as long as the video plays
+	MaxRemuxes int `yaml:"max_remuxes"`
+	// ProbeTimeout and JobTimeout bound the run time of a single ffprobe or ffmpeg
+	// process, time spent waiting in the queue is not counted
+	ProbeTimeout time.Duration `yaml:"probe_timeout"`
+	JobTimeout   time.Duration `yaml:"job_timeout"`
+	// ScanInterval is the delay between two background scans of the videos directory
+	ScanInterval time.Duration `yaml:"scan_interval"`
+	// Watch enables the inotify watcher on the videos directory
+	Watch bool `yaml:"watch"`
 
-// getPort returns the port number from environment variable or default
-func getPort() int {
-	if envPort := os.Getenv("PORT"); envPort != "" {
-		if port, err := strconv.Atoi(envPort); err == nil {
-			return port
-		}
+	// NaturalSort makes natural order ("run_2" before "run_10") the default listing order
+	NaturalSort bool `yaml:"natural_sort"`
+	// SortLocale is the BCP 47 language used to compare names, e.g. "fr" or "de"
+	SortLocale string `yaml:"sort_locale"`
+
+	// Extensions are the files considered as videos, lowercase with a leading
+	// dot after Load. Empty for all known video types.
+	Extensions []string `yaml:"extensions"`
+
+	// Symlinks is the policy for symbolic links in the videos directory:
+	// "deny", "inside" (links must point inside the videos directory) or "follow"
+	Symlinks string `yaml:"symlinks"`
+
+	ThumbnailWidth int           `yaml:"thumbnail_width"` // Pixels, height follows the aspect ratio
+	ThumbnailSeek  time.Duration `yaml:"thumbnail_seek"`  // Position of the frame, avoids black frames at start
+	// CacheSaveDelay groups the writes of the metadata cache to disk
+	CacheSaveDelay time.Duration `yaml:"cache_save_delay"`
+	// ShutdownTimeout is the time given to requests in progress, like
+	// streams, to finish when the server stops
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// HLSIdleTimeout is the delay after which the segments of a video nobody
+	// plays anymore are no longer encoded ahead
+	HLSIdleTimeout time.Duration `yaml:"hls_idle_timeout"`
+	// HLSMaxAge is the delay after which the stored segments of a video
+	// nobody played are deleted
+	HLSMaxAge time.Duration `yaml:"hls_max_age"`
+	// AdminToken must be given as a bearer token to POST /api/admin/reload.
+	// Without it, only requests from the loopback interface are allowed.
+	AdminToken string `yaml:"admin_token"`
+
+	sources map[string]string // Where each value comes from, for Print
+}
+
+// Library is a named videos directory
+type Library struct {
+	Name        string   `yaml:"name"` // Folder of the library at the root of the browser
+	Path        string   `yaml:"path"`
+	ReadOnly    bool     `yaml:"read_only,omitempty"`    // Content never changes, the library is not watched
+	HiddenFiles bool     `yaml:"hidden_files,omitempty"` // List files and folders starting with a dot
+	Extensions  []string `yaml:"extensions,omitempty"`   // Video extensions, all known video types if empty
+}
+
+// Defaults returns the configuration used when nothing is set
+func Defaults() *Config {
+	return &Config{
+		Port:            DefaultPort,
+		DataDir:         DefaultGeneratedDir,
+		MaxJobs:         runtime.NumCPU(),
+		MaxRemuxes:      DefaultMaxRemuxes,
+		ProbeTimeout:    DefaultProbeTimeout,
+		JobTimeout:      DefaultJobTimeout,
+		ScanInterval:    DefaultScanInterval,
+		Watch:           true,
+		NaturalSort:     true,
+		SortLocale:      "und",
+		Symlinks:        "inside",
+		ThumbnailWidth:  DefaultThumbnailWidth,
+		ThumbnailSeek:   DefaultThumbnailSeek,
+		CacheSaveDelay:  DefaultCacheSaveDelay,
+		ShutdownTimeout: DefaultShutdownTimeout,
+		HLSIdleTimeout:  DefaultHLSIdleTimeout,
+		HLSMaxAge:       DefaultHLSMaxAge,
 	}
-	return DefaultPort
 }
 
-// EnsureDirectories creates necessary directories if they don't exist
+var current atomic.Pointer[Config]
+
+func init() {
+	current.Store(Defaults())
+}
+
+// Get returns the configuration in use, it must not be modified
+func Get() *Config {
+	return current.Load()
+}
+
+// Set replaces the configuration in use
+func Set(cfg *Config) {
+	current.Store(cfg)
+}
+
+// Paths of generated files
+func (c *Config) ThumbnailsDir() string { return filepath.Join(c.DataDir, "thumbnails") }
+func (c *Config) SubtitlesDir() string  { return filepath.Join(c.DataDir, "subtitles") }
+func (c *Config) CacheDir() string      { return filepath.Join(c.DataDir, "cache") }
+func (c *Config) HLSDir() string        { return filepath.Join(c.DataDir, "hls") }
+
+// TemplatesDir is optional, templates found here replace the embedded ones
+func (c *Config) TemplatesDir() string { return filepath.Join(c.DataDir, "templates") }
+
+// EnsureDirectories creates the data directories if they don't exist, the
+// data directory must be writable
 func EnsureDirectories() error {
+	cfg := Get()
+
 	dirs := []string{
-		ThumbnailsDir,
-		SubtitlesDir,
+		cfg.ThumbnailsDir(),
+		cfg.SubtitlesDir(),
+		cfg.CacheDir(),
+		cfg.HLSDir(),
 	}
 
 	for _, dir := range dirs {
@@ -45,5 +164,35 @@ func EnsureDirectories() error {
 		}
 	}
 
+	// MkdirAll succeeds on existing read-only directories
+	probe, err := os.CreateTemp(cfg.DataDir, ".write-test-*")
+	if err != nil {
+		return fmt.Errorf("data directory is not writable: %w", err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// CheckSeparate fails if one directory is inside the other. The videos
+// directories are often read-only shares, and would otherwise be scanned with
+// their own thumbnails. Symbolic links are resolved so a link to the videos
+// directory is detected.
+func CheckSeparate(dataDir, videosDir string) error {
+	data, videos := realPath(dataDir), realPath(videosDir)
+	if safepath.Within(videos, data) || safepath.Within(data, videos) {
+		return fmt.Errorf("data directory %s and videos directory %s must not be inside each other", dataDir, videosDir)
+	}
 	return nil
 }
+
+// realPath resolves the symbolic links of the existing part of path
+func realPath(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path
+	}
+	return filepath.Join(realPath(parent), filepath.Base(path))
+}
@@ -0,0 +1,264 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
+
+	"wallplayer/pkg/safepath"
+)
+
+// Every setting has a single name used everywhere: max_jobs in the
+// configuration file, MAX_JOBS in the environment and --max-jobs on the
+// command line. Flags override environment variables, which override the
+// file, which overrides defaults.
+
+// DefaultConfigFile is read from the working directory if it exists and no
+// other file is given with --config or CONFIG_FILE
+const DefaultConfigFile = "wallplayer.yaml"
+
+type setting struct {
+	key   string
+	usage string
+	field func(*Config) any // Pointer to the field holding the value
+}
+
+var settings = []setting{
+	{"port", "HTTP port", func(c *Config) any { return &c.Port }},
+	{"videos_dir", "videos directory, \"videos\" in the working directory if empty", func(c *Config) any { return &c.VideosDir }},
+	{"dev", "serve static files from web/static", func(c *Config) any { return &c.Dev }},
+	{"data_dir", "directory of generated thumbnails, subtitles and cache", func(c *Config) any { return &c.DataDir }},
+	{"max_jobs", "maximum number of ffprobe/ffmpeg processes", func(c *Config) any { return &c.MaxJobs }},
+	{"max_remuxes", "maximum number of videos remuxed to MP4 at once", func(c *Config) any { return &c.MaxRemuxes }},
+	{"probe_timeout", "maximum run time of a single ffprobe process", func(c *Config) any { return &c.ProbeTimeout }},
+	{"job_timeout", "maximum run time of a single ffmpeg process", func(c *Config) any { return &c.JobTimeout }},
+	{"scan_interval", "delay between two background library scans", func(c *Config) any { return &c.ScanInterval }},
+	{"watch", "watch the videos directory for changes", func(c *Config) any { return &c.Watch }},
+	{"natural_sort", "sort numbers in names by value", func(c *Config) any { return &c.NaturalSort }},
+	{"sort_locale", "language used to compare names", func(c *Config) any { return &c.SortLocale }},
+	{"extensions", "comma separated video extensions, all known video types if empty", func(c *Config) any { return &c.Extensions }},
+	{"symlinks", "symbolic links policy: deny, inside or follow", func(c *Config) any { return &c.Symlinks }},
+	{"thumbnail_width", "thumbnail width in pixels", func(c *Config) any { return &c.ThumbnailWidth }},
+	{"thumbnail_seek", "position of the thumbnail frame in the video", func(c *Config) any { return &c.ThumbnailSeek }},
+	{"cache_save_delay", "delay before writing the metadata cache to disk", func(c *Config) any { return &c.CacheSaveDelay }},
+	{"shutdown_timeout", "time given to requests in progress when the server stops", func(c *Config) any { return &c.ShutdownTimeout }},
+	{"hls_idle_timeout", "delay before stopping the HLS encoding ahead of a video nobody plays", func(c *Config) any { return &c.HLSIdleTimeout }},
+	{"hls_max_age", "delay before deleting the stored HLS segments of a video nobody played", func(c *Config) any { return &c.HLSMaxAge }},
+	{"admin_token", "bearer token of the reload endpoint, only allowed from localhost if empty", func(c *Config) any { return &c.AdminToken }},
+}
+
+func (s setting) env() string  { return strings.ToUpper(s.key) }
+func (s setting) flag() string { return strings.ReplaceAll(s.key, "_", "-") }
+
+// Load builds the configuration from args (without the program name), the
+// environment and the configuration file. printOnly is set by --print-config.
+func Load(args []string) (cfg *Config, printOnly bool, err error) {
+	cfg = Defaults()
+	cfg.sources = make(map[string]string)
+
+	// Flags are parsed first to find the configuration file, and applied last
+	type flagValue struct {
+		setting setting
+		value   string
+	}
+	var flagValues []flagValue
+	flags := flag.NewFlagSet("wallplayer", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"),
+		"configuration file, "+DefaultConfigFile+" is used if it exists (env CONFIG_FILE)")
+	flags.BoolVar(&printOnly, "print-config", false, "print the effective configuration and exit")
+	for _, s := range settings {
+		collect := func(value string) error {
+			flagValues = append(flagValues, flagValue{s, value})
+			return nil
+		}
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env())
+		if _, ok := s.field(cfg).(*bool); ok {
+			flags.BoolFunc(s.flag(), usage, collect)
+		} else {
+			flags.Func(s.flag(), usage, collect)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if flags.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	if err := cfg.loadFile(*configFile); err != nil {
+		return nil, false, err
+	}
+	for _, s := range settings {
+		if value := os.Getenv(s.env()); value != "" {
+			if err := cfg.set(s, value, "env "+s.env()); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	for _, f := range flagValues {
+		if err := cfg.set(f.setting, f.value, "flag --"+f.setting.flag()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, false, err
+	}
+	if cfg.DataDir, err = filepath.Abs(cfg.DataDir); err != nil {
+		return nil, false, err
+	}
+	cfg.Extensions = normalizeExtensions(cfg.Extensions)
+	for i := range cfg.Libraries {
+		cfg.Libraries[i].Extensions = normalizeExtensions(cfg.Libraries[i].Extensions)
+	}
+	return cfg, printOnly, nil
+}
+
+// loadFile reads a YAML configuration file, unknown keys are errors so
+// typos are not silently ignored
+func (c *Config) loadFile(path string) error {
+	explicit := path != ""
+	if !explicit {
+		path = DefaultConfigFile
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var keys map[string]any
+	yaml.Unmarshal(data, &keys)
+	for key := range keys {
+		c.sources[key] = "file " + path
+	}
+	return nil
+}
+
+// set parses the value of a setting given as a string
+func (c *Config) set(s setting, value, source string) error {
+	var err error
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *int:
+		*field, err = strconv.Atoi(value)
+	case *bool:
+		*field, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*field, err = time.ParseDuration(value)
+	case *[]string:
+		*field = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid value %q", source, value)
+	}
+	c.sources[s.key] = source
+	return nil
+}
+
+// normalizeExtensions lowercases extensions and adds the leading dot, "MP4" gives ".mp4"
+func normalizeExtensions(extensions []string) []string {
+	normalized := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		normalized = append(normalized, "."+strings.TrimPrefix(strings.ToLower(ext), "."))
+	}
+	return normalized
+}
+
+// Validate checks the values, all problems are reported at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+	check(c.Port > 0 && c.Port < 65536, "port", "%d is not a valid port", c.Port)
+	check(c.DataDir != "", "data_dir", "must not be empty")
+	check(c.MaxJobs > 0, "max_jobs", "must be at least 1")
+	check(c.MaxRemuxes > 0, "max_remuxes", "must be at least 1")
+	check(c.ProbeTimeout > 0, "probe_timeout", "must be positive")
+	check(c.JobTimeout > 0, "job_timeout", "must be positive")
+	check(c.ScanInterval > 0, "scan_interval", "must be positive")
+	check(c.ThumbnailWidth >= 16 && c.ThumbnailWidth <= 4096, "thumbnail_width", "must be between 16 and 4096")
+	check(c.ThumbnailSeek >= 0, "thumbnail_seek", "must not be negative")
+	check(c.CacheSaveDelay >= 0, "cache_save_delay", "must not be negative")
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout", "must not be negative")
+	check(c.HLSIdleTimeout > 0, "hls_idle_timeout", "must be positive")
+	check(c.HLSMaxAge > 0, "hls_max_age", "must be positive")
+	if _, err := language.Parse(c.SortLocale); err != nil {
+		check(false, "sort_locale", "%v", err)
+	}
+	if _, err := safepath.ParsePolicy(c.Symlinks); err != nil {
+		check(false, "symlinks", "%v", err)
+	}
+	names := make(map[string]bool)
+	for i, lib := range c.Libraries {
+		key := fmt.Sprintf("libraries[%d]", i)
+		check(lib.Name != "" && !strings.ContainsAny(lib.Name, `/\`) && lib.Name[0] != '.',
+			key, "name %q must be a non-empty folder name not starting with a dot", lib.Name)
+		check(!names[lib.Name], key, "duplicate name %q", lib.Name)
+		check(lib.Path != "", key, "path must not be empty")
+		names[lib.Name] = true
+	}
+	return errors.Join(errs...)
+}
+
+// Print writes the configuration as YAML, each value commented with where
+// it comes from. The output can be used as a configuration file.
+func (c *Config) Print(w io.Writer) {
+	for _, s := range settings {
+		var value string
+		switch field := s.field(c).(type) {
+		case *string:
+			value = strconv.Quote(*field)
+			if s.key == "admin_token" && *field != "" {
+				value = `"***"`
+			}
+		case *int:
+			value = strconv.Itoa(*field)
+		case *bool:
+			value = strconv.FormatBool(*field)
+		case *time.Duration:
+			value = field.String()
+		case *[]string:
+			value = "[" + strings.Join(*field, ", ") + "]"
+		}
+		source := c.sources[s.key]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintf(w, "%-32s # %s\n", s.key+": "+value, source)
+	}
+	if len(c.Libraries) > 0 {
+		fmt.Fprintf(w, "# %s\n", c.sources["libraries"])
+		data, _ := yaml.Marshal(struct {
+			Libraries []Library `yaml:"libraries"`
+		}{c.Libraries})
+		w.Write(data)
+	}
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// isolate runs a test in an empty working directory, without settings from
+// the environment of the process
+func isolate(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("CONFIG_FILE", "")
+	for _, s := range settings {
+		t.Setenv(s.env(), "")
+	}
+	return dir
+}
+
+// printed returns the lines of Print by setting key
+func printed(cfg *Config) map[string]string {
+	var b strings.Builder
+	cfg.Print(&b)
+	lines := make(map[string]string)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if key, _, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			lines[key] = strings.Join(strings.Fields(line), " ")
+		}
+	}
+	return lines
+}
+
+func TestLoad(t *testing.T) {
+	const file = "port: 1000\njob_timeout: 5m\nmax_jobs: 3\nextensions: [MP4]\n"
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		args  []string
+		check func(t *testing.T, cfg *Config, lines map[string]string)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg *Config, lines map[string]string) {
+				if cfg.Port != DefaultPort || cfg.JobTimeout != DefaultJobTimeout || !cfg.Watch {
+					t.Errorf("config = %+v, want the defaults", cfg)
+				}
+				if want := "port: 9999 # default"; lines["port"] != want {
+					t.Errorf("printed %q, want %q", lines["port"], want)
+				}
+			},
+		},
+		{
+			name: "file",
+			file: file,
+			check: func(t *testing.T, cfg *Config, lines map[string]string) {
+				if cfg.Port != 1000 || cfg.JobTimeout != 5*time.Minute || cfg.MaxJobs != 3 {
+					t.Errorf("config = %+v, want the values of the file", cfg)
+				}
+				if want := "port: 1000 # file " + DefaultConfigFile; lines["port"] != want {
+					t.Errorf("printed %q, want %q", lines["port"], want)
+				}
+			},
+		},
+		{
+			name: "env over file",
+			file: file,
+			env:  map[string]string{"PORT": "2000", "EXTENSIONS": "mkv, .AVI", "ADMIN_TOKEN": "secret"},
+			check: func(t *testing.T, cfg *Config, lines map[string]string) {
+				if cfg.Port != 2000 || cfg.MaxJobs != 3 {
+					t.Errorf("config = %+v, want PORT from the environment, the rest from the file", cfg)
+				}
+				if got := strings.Join(cfg.Extensions, " "); got != ".mkv .avi" {
+					t.Errorf("extensions = %q, want normalized values of the environment", got)
+				}
+				if want := "port: 2000 # env PORT"; lines["port"] != want {
+					t.Errorf("printed %q, want %q", lines["port"], want)
+				}
+				if want := "max_jobs: 3 # file " + DefaultConfigFile; lines["max_jobs"] != want {
+					t.Errorf("printed %q, want %q", lines["max_jobs"], want)
+				}
+				if want := `admin_token: "***" # env ADMIN_TOKEN`; cfg.AdminToken != "secret" || lines["admin_token"] != want {
+					t.Errorf("printed %q, want the token hidden", lines["admin_token"])
+				}
+			},
+		},
+		{
+			name: "flags over env",
+			file: file,
+			env:  map[string]string{"PORT": "2000", "WATCH": "true"},
+			args: []string{"--port", "3000", "--watch=false", "--job-timeout=1m"},
+			check: func(t *testing.T, cfg *Config, lines map[string]string) {
+				if cfg.Port != 3000 || cfg.Watch || cfg.JobTimeout != time.Minute {
+					t.Errorf("config = %+v, want the values of the flags", cfg)
+				}
+				for key, want := range map[string]string{
+					"port":        "port: 3000 # flag --port",
+					"watch":       "watch: false # flag --watch",
+					"job_timeout": "job_timeout: 1m0s # flag --job-timeout",
+				} {
+					if lines[key] != want {
+						t.Errorf("printed %q, want %q", lines[key], want)
+					}
+				}
+			},
+		},
+		{
+			name: "relative data directory",
+			args: []string{"--data-dir", "generated"},
+			check: func(t *testing.T, cfg *Config, lines map[string]string) {
+				if !filepath.IsAbs(cfg.DataDir) || filepath.Base(cfg.DataDir) != "generated" {
+					t.Errorf("data directory = %q, want an absolute path", cfg.DataDir)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			isolate(t)
+			if test.file != "" {
+				if err := os.WriteFile(DefaultConfigFile, []byte(test.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			cfg, printOnly, err := Load(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if printOnly {
+				t.Error("printOnly set without --print-config")
+			}
+			test.check(t, cfg, printed(cfg))
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := isolate(t)
+	path := filepath.Join(dir, "screens.yaml")
+	if err := os.WriteFile(path, []byte("port: 4000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, printOnly, err := Load([]string{"--config", path, "--print-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 4000 || !printOnly {
+		t.Errorf("port = %d, printOnly = %v, want 4000 from the file and true", cfg.Port, printOnly)
+	}
+
+	t.Setenv("CONFIG_FILE", path)
+	if cfg, _, err := Load(nil); err != nil || cfg.Port != 4000 {
+		t.Errorf("Load with CONFIG_FILE = %v, %v, want port 4000", cfg, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want []string // In the error message
+	}{
+		{name: "unknown key", file: "prot: 80\n", want: []string{"prot"}},
+		{name: "invalid env", env: map[string]string{"PORT": "eighty"}, want: []string{"env PORT", "eighty"}},
+		{name: "invalid flag", args: []string{"--job-timeout", "often"}, want: []string{"flag --job-timeout"}},
+		{name: "unknown flag", args: []string{"--colour"}, want: []string{"colour"}},
+		{name: "argument", args: []string{"videos"}, want: []string{"unexpected argument"}},
+		{name: "missing file", args: []string{"--config", "missing.yaml"}, want: []string{"missing.yaml"}},
+		{
+			name: "validation",
+			env:  map[string]string{"PORT": "70000", "MAX_JOBS": "0", "SYMLINKS": "always"},
+			want: []string{"port", "max_jobs", "symlinks"}, // All reported at once
+		},
+		{
+			name: "libraries",
+			file: "libraries:\n  - name: films\n    path: /a\n  - name: films\n  - name: .hidden\n    path: /b\n",
+			want: []string{`duplicate name "films"`, "path must not be empty", `name ".hidden"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			isolate(t)
+			if test.file != "" {
+				if err := os.WriteFile(DefaultConfigFile, []byte(test.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			_, _, err := Load(test.args)
+			if err == nil {
+				t.Fatal("Load succeeded")
+			}
+			for _, want := range test.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
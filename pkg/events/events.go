@@ -0,0 +1,66 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// The events package notifies connected screens that a folder listing
+// changed. Changes are coalesced: copying fifty videos into a folder results
+// in a few notifications instead of fifty.
+
+const (
+	// Delay between the first change and the notification of subscribers
+	settleDelay = 500 * time.Millisecond
+	// Notifications buffered per subscriber, a slow client misses changes
+	// instead of blocking everyone
+	bufferSize = 16
+)
+
+var (
+	mu          sync.Mutex
+	subscribers = make(map[chan string]bool)
+	pending     = make(map[string]bool)
+	timer       *time.Timer
+)
+
+// Subscribe returns a channel receiving the listing path of every changed folder
+func Subscribe() chan string {
+	ch := make(chan string, bufferSize)
+	mu.Lock()
+	subscribers[ch] = true
+	mu.Unlock()
+	return ch
+}
+
+// Unsubscribe stops notifications on ch
+func Unsubscribe(ch chan string) {
+	mu.Lock()
+	delete(subscribers, ch)
+	mu.Unlock()
+}
+
+// Publish reports a change in the folder with the given listing path
+func Publish(path string) {
+	mu.Lock()
+	defer mu.Unlock()
+	pending[path] = true
+	if timer == nil {
+		timer = time.AfterFunc(settleDelay, flush)
+	}
+}
+
+func flush() {
+	mu.Lock()
+	defer mu.Unlock()
+	for path := range pending {
+		for ch := range subscribers {
+			select {
+			case ch <- path:
+			default:
+			}
+		}
+	}
+	pending = make(map[string]bool)
+	timer = nil
+}
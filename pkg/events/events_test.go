@@ -0,0 +1,80 @@
+package events
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// subscribe subscribes until the end of the test
+func subscribe(t *testing.T) chan string {
+	ch := Subscribe()
+	t.Cleanup(func() { Unsubscribe(ch) })
+	return ch
+}
+
+// received returns the paths waiting in ch, sorted
+func received(ch chan string) []string {
+	var paths []string
+	for {
+		select {
+		case path := <-ch:
+			paths = append(paths, path)
+		default:
+			slices.Sort(paths)
+			return paths
+		}
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	ch := subscribe(t)
+	for range 50 {
+		Publish("/talks")
+	}
+	Publish("/")
+
+	if got := received(ch); len(got) > 0 {
+		t.Errorf("notified %q before the changes settled", got)
+	}
+	time.Sleep(settleDelay + 200*time.Millisecond)
+	if got, want := received(ch), []string{"/", "/talks"}; !slices.Equal(got, want) {
+		t.Errorf("notified %q, want %q once each", got, want)
+	}
+
+	// The next change starts a new delay
+	Publish("/talks")
+	time.Sleep(settleDelay + 200*time.Millisecond)
+	if got, want := received(ch), []string{"/talks"}; !slices.Equal(got, want) {
+		t.Errorf("notified %q, want %q", got, want)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	slow, other := subscribe(t), subscribe(t)
+	for i := range bufferSize + 4 {
+		Publish(fmt.Sprintf("/%02d", i))
+	}
+	// flush doesn't wait for slow, whose buffer is full
+	flush()
+	if n := len(received(other)); n != bufferSize {
+		t.Errorf("subscriber got %d notifications, want %d", n, bufferSize)
+	}
+	Publish("/next")
+	flush()
+	if got, want := received(other), []string{"/next"}; !slices.Equal(got, want) {
+		t.Errorf("subscriber got %q, want %q", got, want)
+	}
+	// slow missed the changes that don't fit its buffer
+	if got := received(slow); len(got) != bufferSize || slices.Contains(got, "/next") {
+		t.Errorf("slow subscriber got %q, want %d changes without the last one", got, bufferSize)
+	}
+
+	Unsubscribe(slow)
+	Publish("/later")
+	flush()
+	if got := received(slow); len(got) > 0 {
+		t.Errorf("notified %q after unsubscribing", got)
+	}
+}
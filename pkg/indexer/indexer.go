@@ -0,0 +1,241 @@
+package indexer
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"wallplayer/pkg/browse"
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/search"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/watcher"
+)
+
+// The indexer walks the videos directory and pre-generates metadata and
+// thumbnails through a queue, at background priority so screens always go first.
+
+// Status describes the indexer progress, as returned by /api/admin/jobs
+type Status struct {
+	Scanning bool             `json:"scanning"`
+	LastScan string           `json:"lastScan,omitempty"` // RFC3339
+	NextScan string           `json:"nextScan,omitempty"` // RFC3339
+	Videos   int              `json:"videos"`             // Videos found by the last scan
+	Queued   int              `json:"queued"`
+	Active   int              `json:"active"`
+	Done     int              `json:"done"`
+	Failed   int              `json:"failed"`
+	Indexed  int              `json:"indexed"` // Videos in the search index
+	Pool     video.PoolStatus `json:"pool"`
+}
+
+// background runs the ffprobe/ffmpeg jobs of the indexer
+var background = video.WithPriority(context.Background(), video.Background)
+
+var (
+	mu       sync.Mutex
+	wake     = sync.NewCond(&mu)
+	pending  []string
+	queued   = make(map[string]bool)
+	status   Status
+	lastScan time.Time
+	nextScan time.Time
+)
+
+// Start launches the indexer workers and scans the videos directory now and
+// then every config.Get().ScanInterval
+func Start() {
+	for i := 0; i < config.Get().MaxJobs; i++ {
+		go worker()
+	}
+	go func() {
+		for {
+			Scan()
+			mu.Lock()
+			nextScan = time.Now().Add(config.Get().ScanInterval)
+			mu.Unlock()
+			time.Sleep(config.Get().ScanInterval)
+		}
+	}()
+}
+
+// Scan walks the videos directory and queues every video
+func Scan() {
+	mu.Lock()
+	if status.Scanning {
+		mu.Unlock()
+		return
+	}
+	status.Scanning = true
+	mu.Unlock()
+
+	start := time.Now()
+	var videos []string
+	var skipped []*browse.Library
+	var skippedDirs []string
+	for _, lib := range browse.Libraries() {
+		found, err := browse.VideosIn(lib.Dir)
+		if err != nil {
+			log.Printf("Indexer: error scanning %s: %v", lib.Dir, err)
+		}
+		// Nothing of a library is removed if it can't be fully read or
+		// looks empty, to avoid wiping it while a network share is not mounted
+		if err != nil || len(found) == 0 {
+			skipped = append(skipped, lib)
+			skippedDirs = append(skippedDirs, lib.Dir)
+		}
+		videos = append(videos, found...)
+	}
+
+	// Cleaning first lets old thumbnails be migrated instead of regenerated
+	video.CleanArtifacts(videos, skippedDirs)
+	video.PruneCache(videos, skippedDirs)
+	found := make(map[string]bool, len(videos))
+	for _, path := range videos {
+		found[browse.RelPath(path)] = true
+	}
+	search.Retain(func(rel string) bool {
+		if found[rel] {
+			return true
+		}
+		for _, lib := range skipped {
+			if lib.Name == "" || strings.HasPrefix(rel, lib.Name+"/") {
+				return true
+			}
+		}
+		return false
+	})
+	Queue(videos...)
+
+	mu.Lock()
+	status.Scanning = false
+	status.Videos = len(videos)
+	lastScan = start
+	mu.Unlock()
+	log.Printf("Indexer: found %d videos in %s", len(videos), time.Since(start).Round(time.Millisecond))
+}
+
+// Queue adds videos to the queue, videos already waiting are not added twice
+func Queue(paths ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range paths {
+		if queued[path] {
+			continue
+		}
+		queued[path] = true
+		pending = append(pending, path)
+	}
+	wake.Broadcast()
+}
+
+// HandleChange keeps the caches in sync with a change reported by the watcher:
+// metadata and generated files are dropped, and the video is queued again
+// unless it was removed. Lost events only start a scan: cached metadata and
+// generated files are checked against the size and mtime of the videos, so
+// the ones still valid are kept.
+func HandleChange(ev watcher.Event) {
+	if !ev.IsDir && !browse.IsVideo(ev.Path) {
+		return
+	}
+	log.Printf("Indexer: %s %s", ev.Op, ev.Path)
+	if ev.Op == watcher.Rescan {
+		go Scan()
+		return
+	}
+	video.Invalidate(ev.Path)
+	search.Remove(browse.RelPath(ev.Path))
+
+	switch {
+	case ev.Op == watcher.Remove:
+	case ev.IsDir:
+		videos, err := browse.VideosIn(ev.Path)
+		if err != nil {
+			log.Printf("Indexer: error scanning %s: %v", ev.Path, err)
+		}
+		Queue(videos...)
+	default:
+		Queue(ev.Path)
+	}
+}
+
+// GetStatus returns a snapshot of the indexer progress
+func GetStatus() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	s := status
+	s.Queued = len(pending)
+	if !lastScan.IsZero() {
+		s.LastScan = lastScan.Format(time.RFC3339)
+	}
+	if !nextScan.IsZero() {
+		s.NextScan = nextScan.Format(time.RFC3339)
+	}
+	s.Indexed = search.Size()
+	s.Pool = video.JobStatus()
+	return s
+}
+
+func worker() {
+	for {
+		mu.Lock()
+		for len(pending) == 0 {
+			wake.Wait()
+		}
+		path := pending[0]
+		pending = pending[1:]
+		delete(queued, path)
+		status.Active++
+		mu.Unlock()
+
+		err := video.Prepare(background, path)
+		addToSearch(path)
+
+		mu.Lock()
+		status.Active--
+		if err != nil {
+			status.Failed++
+			log.Printf("Indexer: %s: %v", path, err)
+		} else {
+			status.Done++
+		}
+		mu.Unlock()
+	}
+}
+
+// addToSearch indexes the name, folder, container tags and subtitles of a
+// video. Whatever failed to be generated is simply not searchable.
+func addToSearch(path string) {
+	rel := browse.RelPath(path)
+	doc := search.Document{
+		Path:   rel,
+		Name:   filepath.Base(path),
+		Folder: filepath.ToSlash(filepath.Dir(rel)),
+	}
+	if doc.Folder == "." {
+		doc.Folder = ""
+	}
+
+	info, err := video.GetInfo(background, path)
+	if err == nil {
+		doc.Duration = info.Duration
+		doc.Tags = append(doc.Tags, strings.Split(info.Format, ",")...)
+		var text strings.Builder
+		for _, sub := range info.Subtitles {
+			doc.Tags = append(doc.Tags, sub.Language)
+			subPath, err := video.GetSubtitlePath(path, sub.Language)
+			if err != nil {
+				continue
+			}
+			if vtt, err := os.ReadFile(subPath); err == nil {
+				text.WriteString(search.SubtitleText(string(vtt)))
+			}
+		}
+		doc.Subtitles = text.String()
+	}
+	search.Add(doc)
+}
@@ -4,10 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 
 	"wallplayer/pkg/browse"
@@ -16,8 +17,16 @@ import (
 
 var (
 	ErrInvalidPath = errors.New("invalid path: must be within Videos directory")
+	// ErrNotVideo is returned for directories and other files, like a missing video
+	ErrNotVideo = fmt.Errorf("not a video file: %w", fs.ErrNotExist)
 )
 
+// Stream serves a video with http.ServeContent, which implements RFC 7233
+// range requests: suffix and multiple ranges, ranges clamped to the file
+// size, 416 for unsatisfiable ranges, If-Range and HEAD, and conditional
+// requests. MKV and AVI files with H.264 are remuxed to MP4 instead, see
+// video.PlaybackOf. Errors found before
+// the response starts are returned, the caller writes the error response.
 func Stream(w http.ResponseWriter, r *http.Request, path string) error {
 	// Validate path
 	fullPath, err := validatePath(path)
@@ -37,103 +46,83 @@ func Stream(w http.ResponseWriter, r *http.Request, path string) error {
 	if err != nil {
 		return err
 	}
-	fileSize := info.Size()
 
 	// Check if the file is a video
-	if !isVideoFile(fullPath) {
-		return errors.New("not a video file")
+	if !info.Mode().IsRegular() || !isVideoFile(fullPath) {
+		return ErrNotVideo
 	}
 
-	// Parse range header
-	rangeHeader := r.Header.Get("Range")
-	if rangeHeader == "" {
-		// No range requested, serve full file
-		w.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
-		w.Header().Set("Content-Type", getContentType(fullPath))
-		_, err = io.Copy(w, file)
-		return err
-	}
-
-	// Parse the range header
-	start, end, err := parseRange(rangeHeader, fileSize)
-	if err != nil {
-		return err
-	}
-
-	// Seek to start position
-	if _, err := file.Seek(start, 0); err != nil {
-		return err
+	// Containers browsers don't play are remuxed when their codecs allow it
+	if video.NeedsInfo(fullPath) {
+		info, err := video.GetInfo(r.Context(), fullPath)
+		if err != nil {
+			log.Printf("Stream: %v, sending %s as is", err, path)
+		}
+		if video.PlaybackOf(fullPath, info) == video.Remux {
+			return remux(w, r, fullPath)
+		}
 	}
 
-	// Set headers for partial content
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	// ServeContent answers If-None-Match, If-Modified-Since and If-Range with
+	// the ETag and the modification time. The same path may get another
+	// video: caches must revalidate, which costs a 304.
 	w.Header().Set("Content-Type", getContentType(fullPath))
-	// Ne pas écrire le status si c'est une requête HEAD
-	if r.Method != "HEAD" {
-		w.WriteHeader(http.StatusPartialContent)
-	}
-
-	// Stream the content
-	_, err = io.CopyN(w, file, end-start+1)
-	return err
+	w.Header().Set("ETag", ETag(info))
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	return nil
 }
 
-func validatePath(path string) (string, error) {
-	// Clean the path to resolve any ".." or "." components
-	cleanPath := filepath.Clean(path)
-
-	// Join with base directory
-	fullPath := filepath.Join(browse.BaseDir, cleanPath)
-
-	// Get absolute path
-	absPath, err := filepath.Abs(fullPath)
-	if err != nil {
-		return "", ErrInvalidPath
+// remux streams a video repackaged as fragmented MP4 by ffmpeg. The length
+// of the output is unknown: no ranges, the browser seeks in what it buffered.
+// Errors are returned only if nothing was sent.
+func remux(w http.ResponseWriter, r *http.Request, fullPath string) error {
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Cache-Control", "no-store")
+	// Restarting from the beginning would corrupt the data of a range
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && rangeHeader != "bytes=0-" {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return nil
 	}
-
-	// Check if the path is within BaseDir
-	if !strings.HasPrefix(absPath, browse.BaseDir) {
-		return "", ErrInvalidPath
+	if r.Method == http.MethodHead {
+		return nil
 	}
 
-	return absPath, nil
+	out := &countingWriter{w: w}
+	err := video.RemuxTo(r.Context(), fullPath, out)
+	if err != nil && out.n == 0 {
+		return err
+	}
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Remux of %s stopped: %v", fullPath, err)
+	}
+	return nil
 }
 
-func parseRange(rangeHeader string, fileSize int64) (start int64, end int64, err error) {
-	// Expected format: "bytes=0-1023"
-	parts := strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), "-")
-	if len(parts) != 2 {
-		return 0, 0, errors.New("invalid range format")
-	}
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-	// Parse start
-	if parts[0] == "" {
-		start = 0
-	} else {
-		start, err = strconv.ParseInt(parts[0], 10, 64)
-		if err != nil {
-			return 0, 0, err
-		}
-	}
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
 
-	// Parse end
-	if parts[1] == "" {
-		end = fileSize - 1
-	} else {
-		end, err = strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			return 0, 0, err
-		}
-	}
+// ETag returns a strong validator of a file, built from its size and
+// modification time like the keys of generated files
+func ETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
 
-	// Validate range
-	if start < 0 || end >= fileSize || start > end {
-		return 0, 0, errors.New("invalid range values")
+func validatePath(path string) (string, error) {
+	fullPath, err := browse.Resolve(path)
+	if errors.Is(err, browse.ErrInvalidPath) {
+		return "", ErrInvalidPath
 	}
-
-	return start, end, nil
+	return fullPath, err
 }
 
 func getContentType(path string) string {
@@ -155,5 +144,5 @@ func getContentType(path string) string {
 }
 
 func isVideoFile(path string) bool {
-	return video.IsVideo(path)
+	return browse.IsVideo(path)
 }
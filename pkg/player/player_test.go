@@ -0,0 +1,312 @@
+package player_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/player"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/video/videotest"
+)
+
+// content returns bytes start to end included of a file written by videotest.WriteFile
+func content(start, end int) []byte {
+	data := make([]byte, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		data = append(data, byte(i%251))
+	}
+	return data
+}
+
+func TestStream(t *testing.T) {
+	dir := videotest.Setup(t, videotest.New())
+	path := videotest.WriteFile(t, dir, "clip.mp4", 1000)
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	lastModified := modTime.Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		method       string
+		headers      map[string]string
+		status       int
+		contentRange string
+		body         []byte
+	}{
+		{"full", "GET", nil, http.StatusOK, "", content(0, 999)},
+		{"range", "GET", map[string]string{"Range": "bytes=100-199"}, http.StatusPartialContent, "bytes 100-199/1000", content(100, 199)},
+		{"open range", "GET", map[string]string{"Range": "bytes=900-"}, http.StatusPartialContent, "bytes 900-999/1000", content(900, 999)},
+		{"suffix range", "GET", map[string]string{"Range": "bytes=-300"}, http.StatusPartialContent, "bytes 700-999/1000", content(700, 999)},
+		{"suffix longer than the file", "GET", map[string]string{"Range": "bytes=-5000"}, http.StatusPartialContent, "bytes 0-999/1000", content(0, 999)},
+		{"range past the end", "GET", map[string]string{"Range": "bytes=990-5000"}, http.StatusPartialContent, "bytes 990-999/1000", content(990, 999)},
+		{"unsatisfiable", "GET", map[string]string{"Range": "bytes=1000-"}, http.StatusRequestedRangeNotSatisfiable, "bytes */1000", nil},
+		{"malformed", "GET", map[string]string{"Range": "bytes=abc"}, http.StatusRequestedRangeNotSatisfiable, "", nil},
+		{"If-Range matching", "GET", map[string]string{"Range": "bytes=0-9", "If-Range": lastModified}, http.StatusPartialContent, "bytes 0-9/1000", content(0, 9)},
+		{"If-Range changed", "GET", map[string]string{"Range": "bytes=0-9", "If-Range": modTime.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, "", content(0, 999)},
+		{"HEAD", "HEAD", nil, http.StatusOK, "", nil},
+		{"HEAD range", "HEAD", map[string]string{"Range": "bytes=0-9"}, http.StatusPartialContent, "bytes 0-9/1000", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/api/video/stream?path=clip.mp4", nil)
+			for name, value := range test.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			if err := player.Stream(w, r, "clip.mp4"); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("Content-Range"); got != test.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, test.contentRange)
+			}
+			if test.status/100 == 2 {
+				if got := w.Header().Get("Content-Type"); got != "video/mp4" {
+					t.Errorf("Content-Type = %q, want video/mp4", got)
+				}
+				if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+					t.Errorf("Accept-Ranges = %q, want bytes", got)
+				}
+			}
+			if test.body != nil && !bytes.Equal(w.Body.Bytes(), test.body) {
+				t.Errorf("body has %d bytes, want %d bytes of the file", w.Body.Len(), len(test.body))
+			}
+			if test.method == "HEAD" && w.Body.Len() > 0 {
+				t.Errorf("HEAD response has a %d bytes body", w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestStreamConditional(t *testing.T) {
+	dir := videotest.Setup(t, videotest.New())
+	path := videotest.WriteFile(t, dir, "clip.mp4", 1000)
+	modTime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := func(headers ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/api/video/stream?path=clip.mp4", nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		if err := player.Stream(w, r, "clip.mp4"); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := stream()
+	etag := w.Header().Get("ETag")
+	if etag != fmt.Sprintf(`"3e8-%x"`, modTime.UnixNano()) {
+		t.Errorf("ETag = %s, want size and mtime", etag)
+	}
+	if got := w.Header().Get("Last-Modified"); got != modTime.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified = %q", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("Cache-Control = %q, want no-cache", got)
+	}
+
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+	}{
+		{"If-None-Match", []string{"If-None-Match", etag}, http.StatusNotModified},
+		{"If-None-Match list", []string{"If-None-Match", `"other", ` + etag}, http.StatusNotModified},
+		{"If-None-Match other", []string{"If-None-Match", `"other"`}, http.StatusOK},
+		{"If-Modified-Since", []string{"If-Modified-Since", modTime.Format(http.TimeFormat)}, http.StatusNotModified},
+		{"If-Modified-Since older", []string{"If-Modified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+		// If-None-Match takes precedence
+		{"both", []string{"If-None-Match", `"other"`, "If-Modified-Since", modTime.Format(http.TimeFormat)}, http.StatusOK},
+		{"If-Range ETag", []string{"Range", "bytes=0-9", "If-Range", etag}, http.StatusPartialContent},
+		{"If-Range other ETag", []string{"Range", "bytes=0-9", "If-Range", `"other"`}, http.StatusOK},
+		{"If-Match other", []string{"If-Match", `"other"`}, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		if w := stream(test.headers...); w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+
+	// A modified file gets a new ETag
+	later := modTime.Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if w := stream("If-None-Match", etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("modified file: status = %d, ETag = %s", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestStreamMultipleRanges(t *testing.T) {
+	dir := videotest.Setup(t, videotest.New())
+	videotest.WriteFile(t, dir, "clip.mp4", 1000)
+
+	r := httptest.NewRequest("GET", "/api/video/stream?path=clip.mp4", nil)
+	r.Header.Set("Range", "bytes=0-9, 500-509")
+	w := httptest.NewRecorder()
+	if err := player.Stream(w, r, "clip.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", w.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q, want multipart/byteranges", w.Header().Get("Content-Type"))
+	}
+	parts := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range []struct {
+		contentRange string
+		body         []byte
+	}{
+		{"bytes 0-9/1000", content(0, 9)},
+		{"bytes 500-509/1000", content(500, 509)},
+	} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != want.contentRange || !bytes.Equal(body, want.body) {
+			t.Errorf("part %q with %d bytes, want %q", part.Header.Get("Content-Range"), len(body), want.contentRange)
+		}
+		if part.Header.Get("Content-Type") != "video/mp4" {
+			t.Errorf("part Content-Type = %q, want video/mp4", part.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestStreamRemux(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	videotest.WriteFile(t, dir, "h264.mkv", 1000)
+	videotest.WriteFile(t, dir, "hevc.mkv", 1000)
+	videotest.WriteFile(t, dir, "broken.avi", 1000)
+	fake.Infos["hevc.mkv"] = &video.VideoInfo{VideoCodec: "hevc", AudioCodec: "aac"}
+	fake.Errors["broken.avi"] = errors.New("invalid data")
+
+	stream := func(method, path string, headers ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, "/api/video/stream", nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		if err := player.Stream(w, r, path); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := stream("GET", "h264.mkv")
+	if w.Code != http.StatusOK || w.Body.String() != videotest.RemuxOutput("h264.mkv") {
+		t.Errorf("H.264 MKV: status = %d, body %q, want the remuxed stream", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "video/mp4" {
+		t.Errorf("Content-Type = %q, want video/mp4", got)
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "none" {
+		t.Errorf("Accept-Ranges = %q, want none", got)
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("remuxed stream has ETag %s", etag)
+	}
+	if w := stream("GET", "h264.mkv", "Range", "bytes=0-"); w.Code != http.StatusOK {
+		t.Errorf("range from the start: status = %d, want 200", w.Code)
+	}
+	if w := stream("GET", "h264.mkv", "Range", "bytes=500-"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range: status = %d, want 416", w.Code)
+	}
+	if w := stream("HEAD", "h264.mkv"); w.Code != http.StatusOK || w.Body.Len() > 0 {
+		t.Errorf("HEAD: status = %d, %d bytes body", w.Code, w.Body.Len())
+	}
+	if n := fake.Calls("Remux"); n != 2 {
+		t.Errorf("remuxed %d times, want 2", n)
+	}
+
+	// Codecs browsers don't play, and videos that can't be probed, are sent as is
+	for _, name := range []string{"hevc.mkv", "broken.avi"} {
+		w := stream("GET", name)
+		if w.Code != http.StatusOK || w.Body.Len() != 1000 || w.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%s: status = %d, %d bytes, want the file", name, w.Code, w.Body.Len())
+		}
+	}
+}
+
+func TestStreamRemuxLimit(t *testing.T) {
+	fake := videotest.New()
+	fake.Delay = 200 * time.Millisecond
+	dir := videotest.Setup(t, fake)
+	videotest.WriteFile(t, dir, "h264.mkv", 1000)
+	cfg := *config.Get()
+	cfg.MaxRemuxes = 1
+	config.Set(&cfg)
+
+	done := make(chan error)
+	go func() {
+		r := httptest.NewRequest("GET", "/api/video/stream", nil)
+		done <- player.Stream(httptest.NewRecorder(), r, "h264.mkv")
+	}()
+	deadline := time.Now().Add(time.Second)
+	for video.JobStatus().Remuxing == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first remux didn't start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	r := httptest.NewRequest("GET", "/api/video/stream", nil)
+	if err := player.Stream(httptest.NewRecorder(), r, "h264.mkv"); !errors.Is(err, video.ErrBusy) {
+		t.Errorf("second remux = %v, want ErrBusy", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := video.JobStatus().Remuxing; n != 0 {
+		t.Errorf("%d remuxes running after the end of the stream", n)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	dir := videotest.Setup(t, videotest.New())
+	videotest.WriteFile(t, dir, "notes.txt", 10)
+	videotest.WriteFile(t, dir, "clip.mp4", 10)
+	videotest.WriteFile(t, dir, "talks.mp4/clip.mp4", 10)
+
+	tests := []struct {
+		path string
+		err  error
+	}{
+		{"missing.mp4", os.ErrNotExist},
+		{".hidden/clip.mp4", player.ErrInvalidPath},
+		{"notes.txt", player.ErrNotVideo},
+		{"talks.mp4", player.ErrNotVideo}, // A directory
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/video/stream", nil)
+		err := player.Stream(httptest.NewRecorder(), r, test.path)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Stream(%q) = %v, want %v", test.path, err, test.err)
+		}
+	}
+}
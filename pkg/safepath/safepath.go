@@ -0,0 +1,113 @@
+package safepath
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The safepath package turns a path received from a client into a path of
+// the filesystem, guaranteed to stay below a root directory. Containment is
+// checked on path components, not on string prefixes, so "/videos-private"
+// is not inside "/videos", and symbolic links are checked with a policy.
+
+var (
+	ErrOutside = errors.New("path is outside of the root directory")
+	ErrSymlink = errors.New("path contains a symbolic link")
+)
+
+// Policy tells how symbolic links found in a path are handled
+type Policy int
+
+const (
+	// Deny rejects any path going through a symbolic link
+	Deny Policy = iota
+	// FollowInside accepts symbolic links pointing inside the root
+	FollowInside
+	// Follow accepts any symbolic link, the root only limits ".."
+	Follow
+)
+
+// ParsePolicy reads a policy name: "deny", "inside" or "follow"
+func ParsePolicy(name string) (Policy, error) {
+	switch strings.ToLower(name) {
+	case "deny":
+		return Deny, nil
+	case "inside":
+		return FollowInside, nil
+	case "follow":
+		return Follow, nil
+	}
+	return Deny, fmt.Errorf("unknown symlink policy %q, expected deny, inside or follow", name)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case FollowInside:
+		return "inside"
+	case Follow:
+		return "follow"
+	}
+	return "deny"
+}
+
+// Within reports if path is root or below root, both must be clean absolute paths
+func Within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// Resolve joins rel to root and checks the result stays below root. Every
+// existing component of the path is checked against policy, missing ones
+// are left to the caller which gets the error when opening the file.
+// The returned path is the joined path, links are not replaced by their
+// target so it can still be made relative to root.
+func Resolve(root, rel string, policy Policy) (string, error) {
+	full := filepath.Join(root, filepath.FromSlash(rel))
+	if !Within(root, full) {
+		return "", ErrOutside
+	}
+	if policy == Follow || full == root {
+		return full, nil
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	rest, err := filepath.Rel(root, full)
+	if err != nil {
+		return "", ErrOutside
+	}
+	current := root
+	for _, name := range strings.Split(rest, string(filepath.Separator)) {
+		current = filepath.Join(current, name)
+		info, err := os.Lstat(current)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		if policy == Deny {
+			return "", ErrSymlink
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return "", err
+		}
+		if !Within(realRoot, target) {
+			return "", ErrOutside
+		}
+	}
+	return full, nil
+}
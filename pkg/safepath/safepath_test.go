@@ -0,0 +1,129 @@
+package safepath
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		root, path string
+		want       bool
+	}{
+		{"/videos", "/videos", true},
+		{"/videos", "/videos/a/clip.mp4", true},
+		{"/videos", "/videos/..clip.mp4", true}, // A name starting with dots
+		{"/videos", "/videos-private", false},   // Same prefix, sibling directory
+		{"/videos", "/videos-private/clip.mp4", false},
+		{"/videos", "/video", false},
+		{"/videos", "/", false},
+		{"/videos/a", "/videos", false},
+	}
+	for _, test := range tests {
+		if got := Within(test.root, test.path); got != test.want {
+			t.Errorf("Within(%q, %q) = %v, want %v", test.root, test.path, got, test.want)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{Deny, FollowInside, Follow} {
+		got, err := ParsePolicy(policy.String())
+		if err != nil || got != policy {
+			t.Errorf("ParsePolicy(%q) = %v, %v", policy.String(), got, err)
+		}
+	}
+	if _, err := ParsePolicy("always"); err == nil {
+		t.Error("ParsePolicy of an unknown name succeeded")
+	}
+}
+
+// tree creates a videos directory next to videos-private:
+//
+//	videos/a/clip.mp4
+//	videos/in.mp4 -> a/clip.mp4
+//	videos/indir -> a
+//	videos/out.mp4 -> ../videos-private/secret.mp4
+//	videos/sibling -> ../videos-private
+//	videos/broken -> missing.mp4
+//	videos-private/secret.mp4
+//	link -> videos
+func tree(t *testing.T) (base, root string) {
+	t.Helper()
+	base = t.TempDir()
+	root = filepath.Join(base, "videos")
+	for _, dir := range []string{filepath.Join(root, "a"), filepath.Join(base, "videos-private")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"videos/a/clip.mp4", "videos-private/secret.mp4"} {
+		if err := os.WriteFile(filepath.Join(base, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"videos/in.mp4":  "a/clip.mp4",
+		"videos/indir":   "a",
+		"videos/out.mp4": "../videos-private/secret.mp4",
+		"videos/sibling": "../videos-private",
+		"videos/broken":  "missing.mp4",
+		"link":           "videos",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return base, root
+}
+
+func TestResolve(t *testing.T) {
+	base, root := tree(t)
+	errAny := errors.New("any error")
+	tests := []struct {
+		rel                  string
+		deny, inside, follow error
+	}{
+		{"a/clip.mp4", nil, nil, nil},
+		{"a/missing.mp4", nil, nil, nil}, // Left to the caller
+		{"", nil, nil, nil},
+		{"../videos-private/secret.mp4", ErrOutside, ErrOutside, ErrOutside},
+		{"a/../../videos-private", ErrOutside, ErrOutside, ErrOutside},
+		{"/etc/passwd", nil, nil, nil}, // Below root: root/etc/passwd
+		{"in.mp4", ErrSymlink, nil, nil},
+		{"indir/clip.mp4", ErrSymlink, nil, nil},
+		{"out.mp4", ErrSymlink, ErrOutside, nil},
+		{"sibling/secret.mp4", ErrSymlink, ErrOutside, nil},
+		{"broken", ErrSymlink, errAny, nil},
+	}
+	for _, test := range tests {
+		for _, c := range []struct {
+			policy Policy
+			want   error
+		}{{Deny, test.deny}, {FollowInside, test.inside}, {Follow, test.follow}} {
+			got, err := Resolve(root, test.rel, c.policy)
+			switch {
+			case c.want == nil && err != nil:
+				t.Errorf("Resolve(%q, %s) = %v, want success", test.rel, c.policy, err)
+			case c.want == nil && got != filepath.Join(root, test.rel):
+				t.Errorf("Resolve(%q, %s) = %q, want the joined path", test.rel, c.policy, got)
+			case c.want == errAny && err == nil:
+				t.Errorf("Resolve(%q, %s) succeeded, want an error", test.rel, c.policy)
+			case c.want != nil && c.want != errAny && !errors.Is(err, c.want):
+				t.Errorf("Resolve(%q, %s) = %q, %v, want %v", test.rel, c.policy, got, err, c.want)
+			}
+		}
+	}
+
+	// A root reached through a link: targets are compared to the real root
+	linked := filepath.Join(base, "link")
+	if _, err := Resolve(linked, "in.mp4", FollowInside); err != nil {
+		t.Errorf("Resolve through a linked root = %v, want success", err)
+	}
+	if _, err := Resolve(linked, "out.mp4", FollowInside); !errors.Is(err, ErrOutside) {
+		t.Errorf("Resolve of a link outside a linked root = %v, want ErrOutside", err)
+	}
+}
@@ -0,0 +1,272 @@
+package search
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The search index keeps, for every video of the library, the words found in
+// its name, folder path, container tags and subtitles. Queries match words
+// exactly, by prefix or with a few typos, and results are ranked by where and
+// how well each query word matched.
+
+// Document is a video as indexed by the search
+type Document struct {
+	Path      string   // Path used by the browse API
+	Name      string   // File name
+	Folder    string   // Folder of the video, in the same form as Path
+	Tags      []string // Container format, brand, subtitle languages...
+	Subtitles string   // Subtitle text
+	Duration  float64  // Duration in seconds, returned with results
+}
+
+// Result is a video matching a query
+type Result struct {
+	Path     string  `json:"path"`
+	Name     string  `json:"name"`
+	Folder   string  `json:"folder"`
+	Duration float64 `json:"duration,omitempty"`
+	Score    float64 `json:"score"`
+}
+
+// Field weights, a word in the name matters more than a word said once in the subtitles
+const (
+	weightName      = 4.0
+	weightFolder    = 2.0
+	weightTags      = 1.5
+	weightSubtitles = 1.0
+)
+
+// Match quality
+const (
+	matchExact  = 1.0
+	matchPrefix = 0.7
+	matchFuzzy  = 0.4
+)
+
+// MaxResults is the maximum number of results returned by Search
+const MaxResults = 50
+
+type field struct {
+	weight float64
+	words  map[string]bool
+}
+
+type entry struct {
+	doc    Document
+	fields []field
+}
+
+var (
+	mu    sync.RWMutex
+	index = make(map[string]*entry)
+)
+
+// Add indexes a document, replacing any previous version
+func Add(doc Document) {
+	e := &entry{
+		doc: doc,
+		fields: []field{
+			{weightName, words(strings.TrimSuffix(doc.Name, filepath.Ext(doc.Name)))},
+			{weightFolder, words(doc.Folder)},
+			{weightTags, words(strings.Join(doc.Tags, " "))},
+			{weightSubtitles, words(doc.Subtitles)},
+		},
+	}
+	mu.Lock()
+	index[doc.Path] = e
+	mu.Unlock()
+}
+
+// Remove drops a document, or all documents below a folder
+func Remove(path string) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	mu.Lock()
+	defer mu.Unlock()
+	delete(index, path)
+	for p := range index {
+		if strings.HasPrefix(p, prefix) {
+			delete(index, p)
+		}
+	}
+}
+
+// Retain drops every document whose path keep rejects, after a full scan
+func Retain(keep func(path string) bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for p := range index {
+		if !keep(p) {
+			delete(index, p)
+		}
+	}
+}
+
+// Size returns the number of indexed documents
+func Size() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(index)
+}
+
+// Search returns the documents matching every word of query, best first
+func Search(query string) []Result {
+	terms := make([]string, 0)
+	for word := range words(query) {
+		terms = append(terms, word)
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+
+	mu.RLock()
+	results := make([]Result, 0)
+	for _, e := range index {
+		total := 0.0
+		for _, term := range terms {
+			best := 0.0
+			for _, f := range e.fields {
+				if score := f.weight * matchWords(term, f.words); score > best {
+					best = score
+				}
+			}
+			if best == 0 {
+				total = 0
+				break
+			}
+			total += best
+		}
+		if total > 0 {
+			results = append(results, Result{
+				Path:     e.doc.Path,
+				Name:     e.doc.Name,
+				Folder:   e.doc.Folder,
+				Duration: e.doc.Duration,
+				Score:    total,
+			})
+		}
+	}
+	mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+	if len(results) > MaxResults {
+		results = results[:MaxResults]
+	}
+	return results
+}
+
+// matchWords returns how well term matches the best word of a field
+func matchWords(term string, fieldWords map[string]bool) float64 {
+	if fieldWords[term] {
+		return matchExact
+	}
+	best := 0.0
+	maxTypos := allowedTypos(term)
+	for word := range fieldWords {
+		switch {
+		case strings.HasPrefix(word, term):
+			return matchPrefix
+		case maxTypos > 0 && best == 0 && withinDistance(term, word, maxTypos):
+			best = matchFuzzy
+		}
+	}
+	return best
+}
+
+// allowedTypos returns the edit distance tolerated for a query word,
+// short words must match exactly or by prefix
+func allowedTypos(term string) int {
+	switch n := len([]rune(term)); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// withinDistance reports if the edit distance between a and b is at most max.
+// Swapped letters count as a single typo (optimal string alignment distance).
+func withinDistance(a, b string, max int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if abs(len(ra)-len(rb)) > max {
+		return false
+	}
+	before := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				curr[j] = min(curr[j], before[j-2]+1)
+			}
+			rowMin = min(rowMin, curr[j])
+		}
+		if rowMin > max {
+			return false
+		}
+		before, prev, curr = prev, curr, before
+	}
+	return prev[len(rb)] <= max
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// words splits text into lowercase words without accents, "Réunion_2023-intro"
+// gives reunion, 2023 and intro
+func words(text string) map[string]bool {
+	result := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(fold(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		result[word] = true
+	}
+	return result
+}
+
+// fold lowercases text and removes accents: letters are decomposed and their
+// combining marks dropped, so é, ř or ș lose their accent whether the text
+// comes composed or decomposed like file names on macOS. Folding the whole
+// text before splitting keeps decomposed words in one piece.
+func fold(text string) string {
+	text = strings.ToLower(text)
+	// A transformer has state, one is needed per call
+	unaccent := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	if folded, _, err := transform.String(unaccent, text); err == nil {
+		text = folded
+	}
+	return letters.Replace(text)
+}
+
+// letters replaces the latin letters that have no decomposition
+var letters = strings.NewReplacer(
+	"æ", "ae", "œ", "oe", "ß", "ss", "ø", "o", "ł", "l", "đ", "d", "ð", "d",
+	"ħ", "h", "ı", "i", "þ", "th",
+)
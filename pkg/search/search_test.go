@@ -0,0 +1,149 @@
+package search
+
+import (
+	"strings"
+	"testing"
+)
+
+// reset empties the index for a test
+func reset(t *testing.T, docs ...Document) {
+	t.Helper()
+	mu.Lock()
+	index = make(map[string]*entry)
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		index = make(map[string]*entry)
+		mu.Unlock()
+	})
+	for _, doc := range docs {
+		Add(doc)
+	}
+}
+
+// paths returns the paths of the results of a query, best first
+func paths(query string) string {
+	var got []string
+	for _, r := range Search(query) {
+		got = append(got, r.Path)
+	}
+	return strings.Join(got, " ")
+}
+
+func TestWithinDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		max  int
+		want bool
+	}{
+		{"meeting", "meeting", 0, true},
+		{"meeting", "meting", 1, true},   // Deletion
+		{"meeting", "meeeting", 1, true}, // Insertion
+		{"meeting", "meetimg", 1, true},  // Substitution
+		{"meeting", "meetnig", 1, true},  // Transposition is a single typo
+		{"meeting", "emetnig", 1, false},
+		{"meeting", "emetnig", 2, true},
+		{"meeting", "meet", 2, false}, // Length difference alone is too large
+		{"réunion", "reunion", 1, true},
+		{"", "ab", 2, true},
+	}
+	for _, test := range tests {
+		if got := withinDistance(test.a, test.b, test.max); got != test.want {
+			t.Errorf("withinDistance(%q, %q, %d) = %v, want %v", test.a, test.b, test.max, got, test.want)
+		}
+	}
+}
+
+func TestTypoTolerance(t *testing.T) {
+	reset(t,
+		Document{Path: "cat.mp4", Name: "cat.mp4"},
+		Document{Path: "meeting.mp4", Name: "meeting.mp4"},
+		Document{Path: "presentation.mp4", Name: "presentation.mp4"},
+	)
+	tests := []struct {
+		query, want string
+	}{
+		{"cut", ""},                // 3 letters: no typo
+		{"ca", "cat.mp4"},          // Prefix
+		{"meetnig", "meeting.mp4"}, // 7 letters: 1 typo
+		{"mettnig", ""},
+		{"presantaton", "presentation.mp4"}, // 8 letters and more: 2 typos
+		{"prasantaton", ""},
+	}
+	for _, test := range tests {
+		if got := paths(test.query); got != test.want {
+			t.Errorf("Search(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestRanking(t *testing.T) {
+	reset(t,
+		Document{Path: "a/subtitles.mkv", Name: "subtitles.mkv", Subtitles: "the budget of the year"},
+		Document{Path: "a/tags.mkv", Name: "tags.mkv", Tags: []string{"budget"}},
+		Document{Path: "budget/folder.mkv", Name: "folder.mkv", Folder: "budget"},
+		Document{Path: "a/budget.mkv", Name: "budget.mkv"},
+		Document{Path: "a/prefix.mkv", Name: "budgets 2024.mkv"},
+		Document{Path: "a/fuzzy.mkv", Name: "bugdet.mkv"},
+	)
+	want := "a/budget.mkv a/prefix.mkv budget/folder.mkv a/fuzzy.mkv a/tags.mkv a/subtitles.mkv"
+	if got := paths("budget"); got != want {
+		t.Errorf("Search(budget) = %q, want %q", got, want)
+	}
+
+	// Every word must match, scores add up
+	if got := paths("budget year"); got != "a/subtitles.mkv" {
+		t.Errorf("Search(budget year) = %q, want a/subtitles.mkv", got)
+	}
+}
+
+func TestAccents(t *testing.T) {
+	reset(t, Document{Path: "Réunion_2023-intro.mp4", Name: "Réunion_2023-intro.mp4", Folder: "Été"})
+	for _, query := range []string{"reunion", "RÉUNION", "ete", "2023", "intro"} {
+		if got := paths(query); got != "Réunion_2023-intro.mp4" {
+			t.Errorf("Search(%q) = %q, want the video", query, got)
+		}
+	}
+	// Latin letters beyond French, composed or decomposed
+	reset(t, Document{Path: "a.mp4", Name: "Dvořák Łódź Erdős Timișoara Ærø Straße Re\u0301union.mp4"})
+	for _, query := range []string{"dvorak", "lodz", "erdos", "timisoara", "aero", "strasse", "réunion", "reunion"} {
+		if got := paths(query); got != "a.mp4" {
+			t.Errorf("Search(%q) = %q, want the video", query, got)
+		}
+	}
+	// The extension is not a word of the name
+	if got := paths("mp4"); got != "" {
+		t.Errorf("Search(mp4) = %q, want nothing", got)
+	}
+}
+
+func TestRemoveAndRetain(t *testing.T) {
+	reset(t,
+		Document{Path: "talks/a.mp4", Name: "a.mp4"},
+		Document{Path: "talks/b.mp4", Name: "b.mp4"},
+		Document{Path: "talksx/c.mp4", Name: "c.mp4"},
+	)
+	Remove("talks")
+	if Size() != 1 {
+		t.Errorf("%d documents after removing a folder, want 1", Size())
+	}
+	Retain(func(path string) bool { return path == "talksx/c.mp4" })
+	if Size() != 1 {
+		t.Errorf("%d documents after retaining one, want 1", Size())
+	}
+	Retain(func(string) bool { return false })
+	if Size() != 0 {
+		t.Errorf("%d documents after retaining nothing, want 0", Size())
+	}
+}
+
+func TestSubtitleText(t *testing.T) {
+	vtt := "WEBVTT\nKind: captions\n\nNOTE a comment\nstill the comment\n\n" +
+		"STYLE\n::cue { color: red }\n\n" +
+		"1\n00:00:01.000 --> 00:00:04.000\n<v Alice>Hello <i>everyone</i></v>\n\n" +
+		"intro\n00:00:05.000 --> 00:00:06.000 align:start\r\nSecond <b>line</b>\r\n2024\n"
+	got := strings.Join(strings.Fields(SubtitleText(vtt)), " ")
+	if want := "Hello everyone Second line 2024"; got != want {
+		t.Errorf("SubtitleText = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,42 @@
+package search
+
+import (
+	"regexp"
+	"strings"
+)
+
+var vttTag = regexp.MustCompile(`<[^>]*>`)
+
+// SubtitleText extracts the spoken text of a WebVTT file, without the header,
+// cue identifiers, timings and styling tags
+func SubtitleText(vtt string) string {
+	var b strings.Builder
+	var block []string // Text lines of the current block
+	skipBlock := false
+	flush := func() {
+		for _, line := range block {
+			b.WriteString(vttTag.ReplaceAllString(line, ""))
+			b.WriteByte(' ')
+		}
+		block = nil
+	}
+	for _, line := range strings.Split(vtt, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			flush()
+			skipBlock = false
+		case skipBlock:
+		case strings.HasPrefix(line, "WEBVTT"), strings.HasPrefix(line, "NOTE"),
+			strings.HasPrefix(line, "STYLE"), strings.HasPrefix(line, "REGION"):
+			skipBlock = true
+		case strings.Contains(line, "-->"):
+			// Lines before the timings are the cue identifier
+			block = nil
+		default:
+			block = append(block, line)
+		}
+	}
+	flush()
+	return b.String()
+}
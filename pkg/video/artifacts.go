@@ -0,0 +1,225 @@
+package video
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"wallplayer/pkg/config"
+)
+
+// Generated files (thumbnails, subtitles) are named after a key built from
+// the video path relative to the videos directory, its size and its
+// modification time: <hash>-<size>-<mtime>. Two videos with the same name in
+// different folders get different files, and a modified video gets a new key.
+
+// RelPath maps a full video path to the stable name used to build artifact
+// keys. browse.Init points it at the videos directory, so moving the whole
+// library to another mount point keeps existing thumbnails.
+var RelPath = func(path string) string { return path }
+
+const hashLen = 16 // hex characters kept from the path hash
+
+var (
+	thumbnailName = regexp.MustCompile(`^([0-9a-f]{16})-[0-9a-f]+-[0-9a-f]+(\.[0-9]+)?\.jpg$`)
+	subtitleName  = regexp.MustCompile(`^([0-9a-f]{16})-[0-9a-f]+-[0-9a-f]+_[^_]+\.vtt$`)
+)
+
+// Artifacts ffmpeg failed to generate, e.g. no frame at the thumbnail
+// position or a bitmap subtitle that can't be converted to WebVTT. They are
+// not retried on every request, a modified video gets a new key and is retried.
+var (
+	failed     = make(map[string]bool)
+	failedLock sync.Mutex
+)
+
+func hasFailed(name string) bool {
+	failedLock.Lock()
+	defer failedLock.Unlock()
+	return failed[name]
+}
+
+func markFailed(name string) {
+	failedLock.Lock()
+	defer failedLock.Unlock()
+	failed[name] = true
+}
+
+// pathHash returns the first part of the artifact key, which only depends on the path
+func pathHash(videoPath string) string {
+	sum := sha256.Sum256([]byte(RelPath(videoPath)))
+	return fmt.Sprintf("%x", sum)[:hashLen]
+}
+
+// artifactKey returns the key used to name generated files for a video
+func artifactKey(videoPath string, stat os.FileInfo) string {
+	return fmt.Sprintf("%s-%x-%x", pathHash(videoPath), stat.Size(), stat.ModTime().UnixNano())
+}
+
+// removeStale deletes files generated for a previous version of a video,
+// i.e. files in dir sharing the path hash of key but not the key itself
+func removeStale(dir, key string) {
+	matches, err := filepath.Glob(filepath.Join(dir, key[:hashLen]+"-*"))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		name := filepath.Base(match)
+		if strings.HasPrefix(name, key+".") || strings.HasPrefix(name, key+"_") {
+			continue
+		}
+		if err := os.Remove(match); err == nil {
+			log.Printf("Removed stale artifact %s", name)
+		}
+	}
+}
+
+// removeArtifacts deletes every generated file of a video
+func removeArtifacts(videoPath string) {
+	hash := pathHash(videoPath)
+	for _, dir := range []string{config.Get().ThumbnailsDir(), config.Get().SubtitlesDir(), config.Get().HLSDir()} {
+		matches, _ := filepath.Glob(filepath.Join(dir, hash+"-*"))
+		for _, match := range matches {
+			if !playing(filepath.Base(match)) {
+				os.RemoveAll(match)
+			}
+		}
+	}
+}
+
+// CleanArtifacts migrates files generated with the old basename layout to the
+// new key layout and removes files that don't belong to any video anymore.
+// videos is the complete list of video paths in the libraries but the
+// skipped ones, whose directories couldn't be read: the files of the videos
+// they held when last probed are kept, as are legacy files nobody claims.
+func CleanArtifacts(videos, skipped []string) {
+	keys := make(map[string]string) // path hash => current key
+	kept := make(map[string]bool)   // path hashes of the skipped videos
+	for _, path := range cachedIn(skipped) {
+		kept[pathHash(path)] = true
+	}
+	byName := make(map[string][]string) // legacy name => video paths
+	stats := make(map[string]os.FileInfo)
+	for _, path := range videos {
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		stats[path] = stat
+		keys[pathHash(path)] = artifactKey(path, stat)
+		base := filepath.Base(path)
+		byName[base] = append(byName[base], path)
+		noExt := strings.TrimSuffix(base, filepath.Ext(base))
+		if noExt != base {
+			byName[noExt] = append(byName[noExt], path)
+		}
+	}
+
+	// legacyOwner returns the only video matching a legacy name, if the
+	// artifact is newer than it. Ambiguous names are the collisions we are
+	// getting rid of, they can't be trusted.
+	legacyOwner := func(name string, artifact os.FileInfo) (string, bool) {
+		paths := byName[name]
+		if len(paths) != 1 || artifact.ModTime().Before(stats[paths[0]].ModTime()) {
+			return "", false
+		}
+		return paths[0], true
+	}
+	// unclaimed is the new name of legacy files matching no video
+	unclaimed := func(name string) string {
+		if len(skipped) > 0 {
+			return name
+		}
+		return ""
+	}
+
+	cleanDir(config.Get().ThumbnailsDir(), func(name string, artifact os.FileInfo) string {
+		if m := thumbnailName.FindStringSubmatch(name); m != nil {
+			if keys[m[1]]+".jpg" == name || kept[m[1]] {
+				return name
+			}
+			// Keep thumbnails being generated
+			if m[2] != "" && strings.HasPrefix(name, keys[m[1]]+".") && time.Since(artifact.ModTime()) < config.Get().JobTimeout {
+				return name
+			}
+			return ""
+		}
+		if path, ok := legacyOwner(strings.TrimSuffix(name, ".jpg"), artifact); ok {
+			return artifactKey(path, stats[path]) + ".jpg"
+		}
+		return unclaimed(name)
+	})
+
+	// Segments are kept until the video changes, old ones are pruned by age
+	cleanHLS(func(key string, _ os.FileInfo) bool {
+		return keys[key[:hashLen]] == key || kept[key[:hashLen]]
+	})
+
+	cleanDir(config.Get().SubtitlesDir(), func(name string, artifact os.FileInfo) string {
+		if m := subtitleName.FindStringSubmatch(name); m != nil {
+			if strings.HasPrefix(name, keys[m[1]]+"_") || kept[m[1]] {
+				return name
+			}
+			return ""
+		}
+		// Legacy subtitles are named <basename without ext>_<lang>.vtt
+		base := strings.TrimSuffix(name, ".vtt")
+		sep := strings.LastIndex(base, "_")
+		if sep <= 0 {
+			return unclaimed(name)
+		}
+		if path, ok := legacyOwner(base[:sep], artifact); ok {
+			return artifactKey(path, stats[path]) + base[sep:] + ".vtt"
+		}
+		return unclaimed(name)
+	})
+}
+
+// cleanDir applies target to every file of dir: an empty result removes the
+// file, a different name renames it.
+func cleanDir(dir string, target func(name string, info os.FileInfo) string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Error reading %s: %v", dir, err)
+		return
+	}
+
+	migrated, removed := 0, 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		switch newName := target(name, info); newName {
+		case name:
+		case "":
+			if os.Remove(path) == nil {
+				removed++
+			}
+		default:
+			newPath := filepath.Join(dir, newName)
+			if _, err := os.Stat(newPath); err == nil {
+				// Already generated with the new layout
+				if os.Remove(path) == nil {
+					removed++
+				}
+			} else if os.Rename(path, newPath) == nil {
+				migrated++
+			}
+		}
+	}
+	if migrated > 0 || removed > 0 {
+		log.Printf("%s: migrated %d files, removed %d stale files", dir, migrated, removed)
+	}
+}
@@ -0,0 +1,205 @@
+package video_test
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/video/videotest"
+)
+
+// artifactKey returns the key naming the generated files of a video
+func artifactKey(t *testing.T, videoPath string) string {
+	t.Helper()
+	sub, err := video.GetSubtitlePath(videoPath, "eng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(filepath.Base(sub), "_eng.vtt")
+}
+
+// generated lists the files of the thumbnails and subtitles directories
+func generated(t *testing.T) []string {
+	t.Helper()
+	var names []string
+	for _, dir := range []string{"thumbnails", "subtitles"} {
+		entries, err := os.ReadDir(filepath.Join(config.Get().DataDir, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			names = append(names, dir+"/"+entry.Name())
+		}
+	}
+	return names
+}
+
+func TestCleanArtifacts(t *testing.T) {
+	// Files are named in the data directory, {key} and {hash} stand for the
+	// artifact key of a/clip.mp4 and its path hash. Files are as old as
+	// given, the videos are new.
+	tests := []struct {
+		name  string
+		files map[string]time.Duration
+		want  []string
+	}{
+		{
+			name:  "current",
+			files: map[string]time.Duration{"thumbnails/{key}.jpg": 0, "subtitles/{key}_eng.vtt": 0, "subtitles/{key}_fre.vtt": 0},
+			want:  []string{"thumbnails/{key}.jpg", "subtitles/{key}_eng.vtt", "subtitles/{key}_fre.vtt"},
+		},
+		{
+			name:  "previous version of a video",
+			files: map[string]time.Duration{"thumbnails/{hash}-64-1.jpg": 0, "subtitles/{hash}-64-1_eng.vtt": 0},
+		},
+		{
+			name:  "removed video",
+			files: map[string]time.Duration{"thumbnails/0123456789abcdef-64-1.jpg": 0, "subtitles/0123456789abcdef-64-1_eng.vtt": 0},
+		},
+		{
+			name: "thumbnails being generated",
+			files: map[string]time.Duration{
+				"thumbnails/{key}.123.jpg":       0,
+				"thumbnails/{key}.456.jpg":       time.Hour, // Left by a crash
+				"thumbnails/{hash}-64-1.789.jpg": 0,
+			},
+			want: []string{"thumbnails/{key}.123.jpg"},
+		},
+		{
+			name:  "legacy names",
+			files: map[string]time.Duration{"thumbnails/clip.jpg": 0, "subtitles/clip_eng.vtt": 0},
+			want:  []string{"thumbnails/{key}.jpg", "subtitles/{key}_eng.vtt"},
+		},
+		{
+			name:  "legacy name with the extension",
+			files: map[string]time.Duration{"thumbnails/clip.mp4.jpg": 0},
+			want:  []string{"thumbnails/{key}.jpg"},
+		},
+		{
+			name:  "legacy names older than the video",
+			files: map[string]time.Duration{"thumbnails/clip.jpg": time.Hour, "subtitles/clip_eng.vtt": time.Hour},
+		},
+		{
+			name:  "ambiguous legacy names",
+			files: map[string]time.Duration{"thumbnails/same.jpg": 0, "subtitles/same_eng.vtt": 0},
+		},
+		{
+			name:  "legacy name already migrated",
+			files: map[string]time.Duration{"thumbnails/clip.jpg": 0, "thumbnails/{key}.jpg": 0},
+			want:  []string{"thumbnails/{key}.jpg"},
+		},
+		{
+			name:  "unknown files",
+			files: map[string]time.Duration{"thumbnails/notes.txt": 0, "subtitles/notes.vtt": 0, "subtitles/notes_eng.txt": 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := videotest.Setup(t, videotest.New())
+			videos := []string{
+				videotest.WriteFile(t, dir, "a/clip.mp4", 100),
+				videotest.WriteFile(t, dir, "a/same.mp4", 100),
+				videotest.WriteFile(t, dir, "b/same.mp4", 100),
+			}
+			key := artifactKey(t, videos[0])
+			expand := strings.NewReplacer("{key}", key, "{hash}", key[:16]).Replace
+
+			for name, age := range test.files {
+				path := filepath.Join(config.Get().DataDir, expand(name))
+				if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := time.Now().Add(time.Minute - age) // Newer than the videos unless aged
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			video.CleanArtifacts(videos, nil)
+
+			var want []string
+			for _, name := range test.want {
+				want = append(want, expand(name))
+				// A file in place is kept over a migrated one
+				if _, ok := test.files[name]; ok {
+					data, _ := os.ReadFile(filepath.Join(config.Get().DataDir, expand(name)))
+					if string(data) != name {
+						t.Errorf("%s holds %q, want it unchanged", name, data)
+					}
+				}
+			}
+			got := generated(t)
+			slices.Sort(got)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("after cleaning: %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCleanHLSSegments(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "clip.mp4", 100)
+	fake.Infos["clip.mp4"] = &video.VideoInfo{Duration: 5, Width: 1280, Height: 720}
+	segment, err := video.HLSSegment(t.Context(), path, "720p", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video.CloseHLSSessions(0)
+
+	key := artifactKey(t, path)
+	hlsDir := filepath.Join(config.Get().DataDir, "hls")
+	for _, name := range []string{key[:16] + "-64-1", "0123456789abcdef-64-1", key + "-123456"} {
+		if err := os.MkdirAll(filepath.Join(hlsDir, name, "720p"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the segments of the current version of the video are kept
+	video.CleanArtifacts([]string{path}, nil)
+	entries, err := os.ReadDir(hlsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != key {
+		t.Errorf("after cleaning: %v, want only %s", entries, key)
+	}
+	if _, err := os.Stat(segment); err != nil {
+		t.Errorf("segment of the video was deleted: %v", err)
+	}
+}
+
+func TestCleanArtifactsSkipped(t *testing.T) {
+	dir := videotest.Setup(t, videotest.New())
+	kept := videotest.WriteFile(t, dir, "share/film.mkv", 100)
+	if _, err := video.GetInfo(t.Context(), kept); err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := video.Thumbnail(t.Context(), kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(config.Get().ThumbnailsDir(), "film.jpg")
+	removed := filepath.Join(config.Get().ThumbnailsDir(), "0123456789abcdef-64-1.jpg")
+	for _, path := range []string{legacy, removed} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The share is not mounted: its videos are not listed
+	video.CleanArtifacts(nil, []string{filepath.Join(dir, "share")})
+	got := generated(t)
+	want := []string{"thumbnails/" + filepath.Base(thumb), "thumbnails/film.jpg"}
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("after cleaning: %q, want %q: the files of the share are kept", got, want)
+	}
+}
@@ -0,0 +1,214 @@
+package video
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"wallplayer/pkg/config"
+)
+
+// cacheEntry stores ffprobe results along with the file state they were computed from.
+// An entry is valid as long as the file size and modification time are unchanged,
+// and it was written by the current cacheVersion.
+type cacheEntry struct {
+	Size    int64      `json:"size"`
+	ModTime time.Time  `json:"modTime"`
+	Version int        `json:"version,omitempty"`
+	Info    *VideoInfo `json:"info"`
+}
+
+const cacheFileName = "metadata.json"
+
+// cacheVersion is increased when VideoInfo gets new fields, so videos are probed again.
+// 1: codecs and pixel format
+const cacheVersion = 1
+
+var (
+	cache     = make(map[string]cacheEntry)
+	cacheLock sync.RWMutex
+	cacheOnce sync.Once
+	saveTimer *time.Timer
+)
+
+func cacheFile() string {
+	return filepath.Join(config.Get().CacheDir(), cacheFileName)
+}
+
+// loadCache reads the on-disk metadata cache. A missing or corrupt file
+// simply results in an empty cache.
+func loadCache() {
+	data, err := os.ReadFile(cacheFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading metadata cache: %v", err)
+		}
+		return
+	}
+
+	entries := make(map[string]cacheEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("Ignoring corrupt metadata cache: %v", err)
+		return
+	}
+
+	cacheLock.Lock()
+	for path, entry := range entries {
+		if entry.Info != nil && entry.Version == cacheVersion {
+			cache[path] = entry
+		}
+	}
+	cacheLock.Unlock()
+	log.Printf("Loaded %d entries from metadata cache", len(entries))
+}
+
+// getCached returns the cached info for path if it matches the current file state
+func getCached(path string, stat os.FileInfo) (*VideoInfo, bool) {
+	cacheOnce.Do(loadCache)
+
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	entry, ok := cache[path]
+	if !ok || entry.Version != cacheVersion || entry.Size != stat.Size() || !entry.ModTime.Equal(stat.ModTime()) {
+		return nil, false
+	}
+	return entry.Info, true
+}
+
+// putCached stores info for path and schedules a write of the cache to disk
+func putCached(path string, stat os.FileInfo, info *VideoInfo) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	cache[path] = cacheEntry{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		Version: cacheVersion,
+		Info:    info,
+	}
+	scheduleSave()
+}
+
+// Invalidate drops the cached metadata and the generated files of a video.
+// If path is a directory, every cached video below it is invalidated.
+func Invalidate(path string) {
+	cacheOnce.Do(loadCache)
+
+	paths := []string{path}
+	prefix := path + string(filepath.Separator)
+	cacheLock.Lock()
+	delete(cache, path)
+	for p := range cache {
+		if strings.HasPrefix(p, prefix) {
+			delete(cache, p)
+			paths = append(paths, p)
+		}
+	}
+	scheduleSave()
+	cacheLock.Unlock()
+
+	for _, p := range paths {
+		removeArtifacts(p)
+	}
+}
+
+// PruneCache drops the cached metadata of the videos not in videos, the
+// complete list of video paths in the libraries. Without the watcher this is
+// the only way entries of deleted or renamed videos go away. Entries below
+// skipped, the directories of libraries that couldn't be read, are kept.
+func PruneCache(videos, skipped []string) {
+	cacheOnce.Do(loadCache)
+
+	found := make(map[string]bool, len(videos))
+	for _, path := range videos {
+		found[path] = true
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	pruned := 0
+	for path := range cache {
+		if !found[path] && !inDirs(path, skipped) {
+			delete(cache, path)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		log.Printf("Pruned %d metadata cache entries of missing videos", pruned)
+		scheduleSave()
+	}
+}
+
+// cachedIn returns the cached video paths below dirs
+func cachedIn(dirs []string) []string {
+	cacheOnce.Do(loadCache)
+
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	var paths []string
+	for path := range cache {
+		if inDirs(path, dirs) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// inDirs reports if path is below one of dirs
+func inDirs(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleSave writes the cache to disk after the configured delay, so a
+// folder full of new videos results in a single write instead of one per video.
+// Must be called with cacheLock held.
+func scheduleSave() {
+	if saveTimer == nil {
+		saveTimer = time.AfterFunc(config.Get().CacheSaveDelay, func() {
+			if err := FlushCache(); err != nil {
+				log.Printf("Error saving metadata cache: %v", err)
+			}
+		})
+	}
+}
+
+// FlushCache writes the metadata cache to disk immediately.
+// The file is written to a temporary file first and then renamed, so a crash
+// never leaves a truncated cache behind.
+func FlushCache() error {
+	// Make sure entries from a previous run are not dropped
+	cacheOnce.Do(loadCache)
+
+	cacheLock.Lock()
+	if saveTimer != nil {
+		saveTimer.Stop()
+		saveTimer = nil
+	}
+	data, err := json.Marshal(cache)
+	cacheLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(config.Get().CacheDir(), cacheFileName+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), cacheFile())
+}
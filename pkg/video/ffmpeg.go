@@ -0,0 +1,181 @@
+package video
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/vansante/go-ffprobe"
+)
+
+// MediaProber reads the metadata of a video file
+type MediaProber interface {
+	Probe(ctx context.Context, path string) (*VideoInfo, error)
+}
+
+// MediaTranscoder generates files or streams from a video file. outputPath is
+// overwritten, implementations must stop when ctx ends.
+type MediaTranscoder interface {
+	// Thumbnail writes a JPEG of the frame at seek, scaled to width pixels
+	Thumbnail(ctx context.Context, videoPath, outputPath string, seek time.Duration, width int) error
+	// Subtitle converts a subtitle stream to WebVTT
+	Subtitle(ctx context.Context, videoPath string, streamIndex int, outputPath string) error
+	// Remux writes the first video and audio streams to w as fragmented MP4,
+	// without encoding
+	Remux(ctx context.Context, videoPath string, w io.Writer) error
+	// Segment encodes a part of the video to an MPEG-TS file playable by
+	// every browser, keeping the timestamps of the video
+	Segment(ctx context.Context, videoPath, outputPath string, opts SegmentOptions) error
+}
+
+// SegmentOptions describes an HLS segment
+type SegmentOptions struct {
+	Start    time.Duration
+	Duration time.Duration
+	// Height scales the video keeping its aspect ratio, 0 keeps its size
+	Height int
+	// VideoBitrate caps the bitrate of the video in bits/s, 0 for no cap
+	VideoBitrate int64
+}
+
+// Prober and Transcoder do the work of the package, they are replaced by
+// videotest.Fake in tests. Calls go through the job pool, they are never
+// made directly.
+var (
+	Prober     MediaProber     = FFmpeg{}
+	Transcoder MediaTranscoder = FFmpeg{}
+)
+
+// FFmpeg runs the ffprobe and ffmpeg commands found in PATH
+type FFmpeg struct{}
+
+func (FFmpeg) Probe(ctx context.Context, path string) (*VideoInfo, error) {
+	data, err := ffprobe.GetProbeDataContext(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	bitrate := int64(0)
+	if data.Format.BitRate != "" {
+		fmt.Sscanf(data.Format.BitRate, "%d", &bitrate)
+	}
+
+	info := &VideoInfo{
+		Duration: data.Format.DurationSeconds,
+		Format:   data.Format.FormatName,
+		Bitrate:  bitrate,
+	}
+
+	// Get video and subtitle stream info
+	for _, stream := range data.Streams {
+		switch stream.CodecType {
+		case "video":
+			// Cover art of audio files and MKV attachments are video streams too
+			if stream.Disposition.AttachedPic != 0 || info.VideoCodec != "" {
+				continue
+			}
+			info.Width = stream.Width
+			info.Height = stream.Height
+			info.VideoCodec = stream.CodecName
+			info.PixelFormat = stream.PixFmt
+		case "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = stream.CodecName
+			}
+		case "subtitle":
+			lang := "und"
+			if stream.Tags.Language != "" {
+				lang = stream.Tags.Language
+			}
+
+			subtitle := SubtitleInfo{
+				StreamIndex: stream.Index,
+				Codec:       stream.CodecName,
+				Language:    lang,
+			}
+
+			info.Subtitles = append(info.Subtitles, subtitle)
+		}
+	}
+	return info, nil
+}
+
+func (FFmpeg) Thumbnail(ctx context.Context, videoPath, outputPath string, seek time.Duration, width int) error {
+	// Generate thumbnail using ffmpeg with the following arguments:
+	args := []string{
+		"-v", "error", // Only show errors in output
+		"-ss", strconv.FormatFloat(seek.Seconds(), 'f', -1, 64), // Seek (avoid black frames at start)
+		"-i", videoPath, // Input file
+		"-frames:v", "1", // Extract exactly one frame
+		"-q:v", "2", // Quality factor (2-31, lower is better quality)
+		"-vf", fmt.Sprintf("scale=%d:-1", width), // Scale width, height auto (-1)
+		"-y",       // Overwrite the output file
+		outputPath, // Output file path
+	}
+	return exec.CommandContext(ctx, "ffmpeg", args...).Run()
+}
+
+func (FFmpeg) Subtitle(ctx context.Context, videoPath string, streamIndex int, outputPath string) error {
+	// Build ffmpeg command to extract directly to WebVTT
+	args := []string{
+		"-i", videoPath,
+		"-map", fmt.Sprintf("0:%d", streamIndex),
+		"-f", "webvtt",
+		"-c:s", "webvtt",
+		"-y", // Overwrite the output file
+		outputPath,
+	}
+	// Suppress ffmpeg stderr output
+	return exec.CommandContext(ctx, "ffmpeg", args...).Run()
+}
+
+func (FFmpeg) Remux(ctx context.Context, videoPath string, w io.Writer) error {
+	args := []string{
+		"-v", "error",
+		"-fflags", "+genpts", // AVI packets have no PTS, the mp4 muxer needs them with B-frames
+		"-i", videoPath,
+		"-map", "0:v:0", // First video stream
+		"-map", "0:a:0?", // First audio stream, if any
+		"-c", "copy", // No encoding, the codecs are already playable
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof", // Fragmented MP4, written as it goes
+		"-f", "mp4",
+		"pipe:1",
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = w
+	return cmd.Run()
+}
+
+func (FFmpeg) Segment(ctx context.Context, videoPath, outputPath string, opts SegmentOptions) error {
+	start := strconv.FormatFloat(opts.Start.Seconds(), 'f', -1, 64)
+	args := []string{
+		"-v", "error",
+		"-ss", start, // Seek before the input: fast, and exact when encoding
+		"-i", videoPath,
+		"-t", strconv.FormatFloat(opts.Duration.Seconds(), 'f', -1, 64),
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23",
+	}
+	if opts.Height > 0 {
+		args = append(args, "-vf", "scale=-2:"+strconv.Itoa(opts.Height)) // -2: even width
+	}
+	if opts.VideoBitrate > 0 {
+		// Constant quality, unless it needs more than the rendition allows
+		args = append(args,
+			"-maxrate", strconv.FormatInt(opts.VideoBitrate, 10),
+			"-bufsize", strconv.FormatInt(2*opts.VideoBitrate, 10))
+	}
+	args = append(args,
+		"-pix_fmt", "yuv420p", // 8 bits 4:2:0, the only format all browsers decode
+		"-c:a", "aac", "-b:a", "128k", "-ac", "2",
+		"-output_ts_offset", start, // Segments follow each other on the timeline
+		"-muxdelay", "0",
+		"-f", "mpegts",
+		"-y", outputPath,
+	)
+	return exec.CommandContext(ctx, "ffmpeg", args...).Run()
+}
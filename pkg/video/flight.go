@@ -0,0 +1,89 @@
+package video
+
+import (
+	"context"
+	"sync"
+)
+
+// Screens of a video wall often request the same thumbnail or subtitle at
+// the same time. Requests for an artifact being generated wait for the
+// running job instead of starting another ffmpeg. The job runs as long as
+// someone waits for it: when the last request goes away, e.g. the browser
+// left the folder, ffmpeg is killed.
+
+// flight is a job shared by the callers of share with the same key
+type flight struct {
+	done    chan struct{} // Closed when value and err are set
+	value   any
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+	prio    Priority
+	promote chan struct{} // Closed when an interactive caller joins a background job
+}
+
+var (
+	flights     = make(map[string]*flight)
+	flightsLock sync.Mutex
+)
+
+type flightKey struct{}
+
+// promotion returns the channel closed when the job of ctx becomes
+// interactive, nil outside of share
+func promotion(ctx context.Context) <-chan struct{} {
+	if f, ok := ctx.Value(flightKey{}).(*flight); ok {
+		return f.promote
+	}
+	return nil
+}
+
+// share calls job once for all the concurrent callers with the same key and
+// gives them its result. A caller whose ctx ends stops waiting with the
+// error of ctx, the job is canceled when no caller is left.
+func share[T any](ctx context.Context, key string, job func(ctx context.Context) (T, error)) (T, error) {
+	prio := priority(ctx)
+
+	flightsLock.Lock()
+	f, ok := flights[key]
+	if !ok {
+		// The job doesn't depend on the first caller staying
+		jobCtx, cancel := context.WithCancel(stopCtx)
+		f = &flight{done: make(chan struct{}), cancel: cancel, prio: prio, promote: make(chan struct{})}
+		jobCtx = context.WithValue(jobCtx, flightKey{}, f)
+		flights[key] = f
+		go func() {
+			value, err := job(jobCtx)
+			flightsLock.Lock()
+			if flights[key] == f {
+				delete(flights, key)
+			}
+			flightsLock.Unlock()
+			cancel()
+			f.value, f.err = value, err
+			close(f.done)
+		}()
+	} else if prio < f.prio {
+		f.prio = prio
+		close(f.promote)
+	}
+	f.waiters++
+	flightsLock.Unlock()
+
+	select {
+	case <-f.done:
+		return f.value.(T), f.err
+	case <-ctx.Done():
+		flightsLock.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			if flights[key] == f {
+				delete(flights, key)
+			}
+		}
+		flightsLock.Unlock()
+		var zero T
+		return zero, ctx.Err()
+	}
+}
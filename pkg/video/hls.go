@@ -0,0 +1,409 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"wallplayer/pkg/config"
+)
+
+// HLS plays the videos whose codecs browsers don't decode, and any video on
+// screens with a weak connection. The master playlist offers renditions of
+// the video at several sizes and bitrates, the player switches between them
+// as the bandwidth changes. The playlist of a rendition lists segments of
+// SegmentDuration computed from the duration of the video, and each segment
+// is encoded when it is requested, on its own: seeking or switching asks for
+// any segment. The following ones are encoded ahead while the video is
+// played, until nobody played it for HLS_IDLE_TIMEOUT. Segments are stored in
+// data/hls/<key>/<rendition>/ and reused by later plays, after a restart too,
+// until the video changes or nobody played it for HLS_MAX_AGE.
+
+// SegmentDuration is the length of HLS segments, the last one is shorter
+const SegmentDuration = 6 * time.Second
+
+// prefetchSegments are encoded ahead of the segment being played
+const prefetchSegments = 2
+
+// audioBitrate is the bitrate of the AAC audio of every rendition, see FFmpeg.Segment
+const audioBitrate = 128_000
+
+var (
+	errNoSegment   = fmt.Errorf("no such segment: %w", fs.ErrNotExist)
+	errNoRendition = fmt.Errorf("no such rendition: %w", fs.ErrNotExist)
+)
+
+// Rendition is a quality of the HLS stream of a video
+type Rendition struct {
+	Name         string // Folder of its playlist and segments, e.g. "720p"
+	Height       int    // Pixels, 0 keeps the size of the video
+	VideoBitrate int64  // Bits/s, the encoder doesn't go above
+}
+
+// ladder lists the renditions offered, from the best
+var ladder = []Rendition{
+	{"1080p", 1080, 5_000_000},
+	{"720p", 720, 2_800_000},
+	{"480p", 480, 1_200_000},
+}
+
+// Renditions returns the renditions of a video, from the best: those of the
+// ladder not larger than the video, with bitrates capped to the bitrate of
+// the video. A rendition is only offered if it needs less bandwidth than the
+// previous one. A video smaller than every rendition gets one at its size.
+func Renditions(info *VideoInfo) []Rendition {
+	capped := func(r Rendition) Rendition {
+		if info.Bitrate > 0 {
+			r.VideoBitrate = min(r.VideoBitrate, info.Bitrate)
+		}
+		return r
+	}
+	var renditions []Rendition
+	for _, r := range ladder {
+		if info.Height > 0 && r.Height > info.Height {
+			continue
+		}
+		r = capped(r)
+		if n := len(renditions); n > 0 && r.VideoBitrate >= renditions[n-1].VideoBitrate {
+			continue
+		}
+		renditions = append(renditions, r)
+	}
+	if len(renditions) == 0 {
+		r := capped(ladder[len(ladder)-1])
+		r.Name, r.Height = fmt.Sprintf("%dp", info.Height), 0
+		renditions = append(renditions, r)
+	}
+	return renditions
+}
+
+// rendition finds a rendition of a video by name
+func rendition(info *VideoInfo, name string) (Rendition, error) {
+	for _, r := range Renditions(info) {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return Rendition{}, errNoRendition
+}
+
+// session tracks the encoding of the segments of a video being played
+type session struct {
+	dir      string // data/hls/<key>
+	lastUsed time.Time
+	ctx      context.Context // Ends with the session, stops prefetching and encoding
+	cancel   context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	work   sync.WaitGroup // Prefetches and encodings writing to dir
+}
+
+// hlsDirName matches the directories of data/hls, named after artifact keys
+var hlsDirName = regexp.MustCompile(`^([0-9a-f]{16})-[0-9a-f]+-[0-9a-f]+$`)
+
+var (
+	sessions     = make(map[string]*session) // By artifact key
+	sessionsLock sync.Mutex
+	janitorOnce  sync.Once
+)
+
+// HLSMasterPlaylist returns the master playlist of a video, the playlists
+// of the renditions are named <rendition>/index.m3u8 relative to it
+func HLSMasterPlaylist(ctx context.Context, videoPath string) (string, error) {
+	info, err := GetInfo(ctx, videoPath)
+	if err != nil {
+		return "", err
+	}
+	if len(segments(info.Duration)) == 0 {
+		return "", errors.New("unknown duration")
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, r := range Renditions(info) {
+		// BANDWIDTH is the peak the player must sustain: the cap of the video
+		// and the audio
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", r.VideoBitrate+audioBitrate)
+		if width, height := r.size(info); width > 0 && height > 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", width, height)
+		}
+		fmt.Fprintf(&b, "\n%s/index.m3u8\n", r.Name)
+	}
+	return b.String(), nil
+}
+
+// size returns the dimensions of a rendition of a video, 0 when unknown
+func (r Rendition) size(info *VideoInfo) (width, height int) {
+	if r.Height == 0 || info.Height == 0 {
+		return info.Width, info.Height
+	}
+	// Like scale=-2:<height>: the width follows the aspect ratio, rounded to even
+	return int(math.Round(float64(info.Width)*float64(r.Height)/float64(info.Height)/2)) * 2, r.Height
+}
+
+// HLSPlaylist returns the media playlist of a rendition of a video, segments
+// are named segment-<n>.ts relative to the playlist
+func HLSPlaylist(ctx context.Context, videoPath, renditionName string) (string, error) {
+	info, err := GetInfo(ctx, videoPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := rendition(info, renditionName); err != nil {
+		return "", err
+	}
+	lengths := segments(info.Duration)
+	if len(lengths) == 0 {
+		return "", errors.New("unknown duration")
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n", int(SegmentDuration.Seconds()))
+	for n, length := range lengths {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nsegment-%d.ts\n", length.Seconds(), n)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String(), nil
+}
+
+// segments returns the length of each segment of a video
+func segments(duration float64) []time.Duration {
+	total := time.Duration(duration * float64(time.Second))
+	count := int(math.Ceil(float64(total) / float64(SegmentDuration)))
+	lengths := make([]time.Duration, count)
+	for n := range lengths {
+		lengths[n] = min(SegmentDuration, total-time.Duration(n)*SegmentDuration)
+	}
+	return lengths
+}
+
+// HLSSegment returns the path of segment n of a rendition of a video,
+// encoding it if needed
+func HLSSegment(ctx context.Context, videoPath, renditionName string, n int) (string, error) {
+	stat, err := os.Stat(videoPath)
+	if err != nil {
+		return "", err
+	}
+	info, err := GetInfo(ctx, videoPath)
+	if err != nil {
+		return "", err
+	}
+	r, err := rendition(info, renditionName)
+	if err != nil {
+		return "", err
+	}
+	lengths := segments(info.Duration)
+	if n < 0 || n >= len(lengths) {
+		return "", errNoSegment
+	}
+
+	s, err := openSession(artifactKey(videoPath, stat))
+	if err != nil {
+		return "", err
+	}
+	segmentPath, err := s.encode(ctx, videoPath, r, n, lengths[n])
+	if err != nil {
+		return "", err
+	}
+
+	// The player asks for the next segments soon, they are ready by then.
+	// A request joining a prefetch moves it to the interactive queue.
+	for next := n + 1; next <= n+prefetchSegments && next < len(lengths); next++ {
+		if !s.track() {
+			break
+		}
+		go func() {
+			defer s.work.Done()
+			s.encode(WithPriority(s.ctx, Background), videoPath, r, next, lengths[next])
+		}()
+	}
+	return segmentPath, nil
+}
+
+// track counts work of the session, false once it is closed
+func (s *session) track() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.work.Add(1)
+	return true
+}
+
+// close stops the work of the session and waits for it. The segments stay,
+// the modification time of their directory records the last play.
+func (s *session) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.cancel()
+	s.work.Wait()
+	os.Chtimes(s.dir, s.lastUsed, s.lastUsed)
+}
+
+// openSession returns the session of a video, creating it if needed
+func openSession(key string) (*session, error) {
+	janitorOnce.Do(startJanitor)
+
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	s, ok := sessions[key]
+	if !ok {
+		dir := filepath.Join(config.Get().HLSDir(), key)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		s = &session{dir: dir}
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		sessions[key] = s
+	}
+	s.lastUsed = time.Now()
+	return s, nil
+}
+
+// playing reports if a video has a session, its segments must be kept
+func playing(key string) bool {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	_, ok := sessions[key]
+	return ok
+}
+
+// encode returns the path of a segment, encoding it if needed. Concurrent
+// requests for the same segment share one ffmpeg, which is stopped when the
+// session is closed.
+func (s *session) encode(ctx context.Context, videoPath string, r Rendition, n int, length time.Duration) (string, error) {
+	name := fmt.Sprintf("segment-%d.ts", n)
+	dir := filepath.Join(s.dir, r.Name)
+	segmentPath := filepath.Join(dir, name)
+	if _, err := os.Stat(segmentPath); err == nil {
+		return segmentPath, nil
+	}
+	return share(ctx, "hls/"+segmentPath, func(ctx context.Context) (string, error) {
+		if !s.track() {
+			return "", context.Canceled
+		}
+		defer s.work.Done()
+		ctx, stop := context.WithCancel(ctx)
+		defer stop()
+		defer context.AfterFunc(s.ctx, stop)()
+
+		// Encoded by a job that just finished
+		if _, err := os.Stat(segmentPath); err == nil {
+			return segmentPath, nil
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+
+		// Write to a temporary file so a segment being encoded is never served
+		tmp, err := os.CreateTemp(dir, name+".*")
+		if err != nil {
+			return "", err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		opts := SegmentOptions{
+			Start:        time.Duration(n) * SegmentDuration,
+			Duration:     length,
+			Height:       r.Height,
+			VideoBitrate: r.VideoBitrate,
+		}
+		err = run(ctx, config.Get().JobTimeout, func(ctx context.Context) error {
+			return Transcoder.Segment(ctx, videoPath, tmp.Name(), opts)
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error encoding %s/%s of %s: %v", r.Name, name, videoPath, err)
+			}
+			return "", err
+		}
+		if info, err := os.Stat(tmp.Name()); err != nil || info.Size() == 0 {
+			return "", fmt.Errorf("ffmpeg produced an empty %s", name)
+		}
+		return segmentPath, os.Rename(tmp.Name(), segmentPath)
+	})
+}
+
+// startJanitor deletes the partial segments left by a previous run, then
+// closes idle sessions and deletes old segments every minute
+func startJanitor() {
+	// Runs before the first session of this run: nothing is being encoded
+	partial, _ := filepath.Glob(filepath.Join(config.Get().HLSDir(), "*", "*", "segment-*.ts.*"))
+	for _, path := range partial {
+		os.Remove(path)
+	}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			CloseHLSSessions(config.Get().HLSIdleTimeout)
+			PruneHLSSegments(config.Get().HLSMaxAge)
+		}
+	}()
+}
+
+// CloseHLSSessions stops the prefetching and encoding of the videos not
+// played for idle, of every video for 0, and waits for their ffmpeg to exit.
+// Their segments are kept.
+func CloseHLSSessions(idle time.Duration) {
+	var closed []*session
+	sessionsLock.Lock()
+	for key, s := range sessions {
+		if time.Since(s.lastUsed) >= idle {
+			delete(sessions, key)
+			closed = append(closed, s)
+		}
+	}
+	sessionsLock.Unlock()
+
+	for _, s := range closed {
+		s.close()
+	}
+}
+
+// PruneHLSSegments deletes the segments of the videos not played for age
+func PruneHLSSegments(age time.Duration) {
+	cleanHLS(func(key string, info os.FileInfo) bool {
+		return time.Since(info.ModTime()) < age
+	})
+}
+
+// cleanHLS deletes the directories of data/hls that keep rejects, except
+// those of the videos being played. Directories not named after a key are
+// left by older versions, they are deleted.
+func cleanHLS(keep func(key string, info os.FileInfo) bool) {
+	dir := config.Get().HLSDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		key := entry.Name()
+		info, err := entry.Info()
+		if err != nil || playing(key) {
+			continue
+		}
+		if hlsDirName.MatchString(key) && keep(key, info) {
+			continue
+		}
+		if os.RemoveAll(filepath.Join(dir, key)) == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("%s: removed the segments of %d videos", dir, removed)
+	}
+}
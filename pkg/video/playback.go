@@ -0,0 +1,96 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"wallplayer/pkg/config"
+)
+
+// Playback is the way a video is sent to browsers
+type Playback string
+
+const (
+	Direct Playback = "direct" // The file as is, with range requests
+	Remux  Playback = "remux"  // Repackaged as fragmented MP4 by ffmpeg, without encoding
+	HLS    Playback = "hls"    // Encoded to H.264/AAC segments on demand, see hls.go
+)
+
+// Containers played by browsers when their codecs are, other containers
+// holding codecs browsers play are remuxed, the rest is encoded for HLS
+var directContainers = map[string]bool{
+	".mp4":  true,
+	".m4v":  true,
+	".mov":  true,
+	".webm": true,
+}
+
+var (
+	// Codecs of direct containers decoded by browsers, "" when ffprobe didn't
+	// report one: the file is sent as is
+	directVideoCodecs = map[string]bool{"": true, "h264": true, "vp8": true, "vp9": true, "av1": true}
+	directAudioCodecs = map[string]bool{"": true, "aac": true, "mp3": true, "opus": true, "vorbis": true}
+	remuxVideoCodecs  = map[string]bool{"h264": true}
+	remuxAudioCodecs  = map[string]bool{"": true, "aac": true, "mp3": true}
+	// 8 bits 4:2:0, 10 bits and 4:2:2 video don't play in most browsers
+	playablePixelFormat = map[string]bool{"": true, "yuv420p": true, "yuvj420p": true}
+)
+
+// NeedsInfo reports if the stream of a video depends on its metadata:
+// videos of direct containers are sent as is by /api/video/stream, without
+// probing. Their codecs only matter to PlaybackOf, which tells the client
+// to use HLS instead.
+func NeedsInfo(path string) bool {
+	return !directContainers[strings.ToLower(filepath.Ext(path))]
+}
+
+// PlaybackOf chooses how a video is played from its container and codecs:
+// direct when browsers decode everything, remuxed when only the container
+// is a problem, encoded for HLS otherwise. info may be nil when probing
+// failed: the file is sent as is. Encoding needs the duration to build the
+// playlist.
+func PlaybackOf(path string, info *VideoInfo) Playback {
+	if info == nil {
+		return Direct
+	}
+	playable := playablePixelFormat[info.PixelFormat]
+	switch {
+	case !NeedsInfo(path):
+		if playable && directVideoCodecs[info.VideoCodec] && directAudioCodecs[info.AudioCodec] {
+			return Direct
+		}
+	case playable && remuxVideoCodecs[info.VideoCodec] && remuxAudioCodecs[info.AudioCodec]:
+		return Remux
+	}
+	if info.Duration > 0 {
+		return HLS
+	}
+	return Direct
+}
+
+// ErrBusy is returned by RemuxTo when MAX_REMUXES videos are already remuxed
+var ErrBusy = errors.New("too many videos remuxed at once")
+
+// remuxing counts the running remuxes
+var remuxing atomic.Int64
+
+// RemuxTo streams a video repackaged as fragmented MP4 to w until the end of
+// the video or of ctx. It doesn't wait in the job pool: copying streams costs
+// little and lasts as long as playback. Remuxes have their own limit instead,
+// a request beyond it fails at once with ErrBusy. CancelJobs stops it.
+func RemuxTo(ctx context.Context, videoPath string, w io.Writer) error {
+	if remuxing.Add(1) > int64(config.Get().MaxRemuxes) {
+		remuxing.Add(-1)
+		return ErrBusy
+	}
+	defer remuxing.Add(-1)
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	defer context.AfterFunc(stopCtx, stop)()
+	return Transcoder.Remux(ctx, videoPath, w)
+}
@@ -0,0 +1,202 @@
+package video
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"wallplayer/pkg/config"
+)
+
+// Priority of an ffprobe/ffmpeg job. Interactive jobs always leave the queue
+// before background jobs.
+type Priority int
+
+const (
+	Interactive Priority = iota // Requested by a screen, someone is waiting for it
+	Background                  // Pre-generation, nobody is waiting
+	numPriorities
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context running the jobs it is given to with prio
+func WithPriority(ctx context.Context, prio Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, prio)
+}
+
+// priority returns the priority of jobs run with ctx, Interactive by default
+// since contexts usually come from HTTP requests. Shared jobs take the
+// highest priority of their callers.
+func priority(ctx context.Context) Priority {
+	if f, ok := ctx.Value(flightKey{}).(*flight); ok {
+		flightsLock.Lock()
+		defer flightsLock.Unlock()
+		return f.prio
+	}
+	if prio, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return prio
+	}
+	return Interactive
+}
+
+// pool limits the number of ffprobe/ffmpeg processes running at once.
+// Jobs that can't start immediately are queued in FIFO order per priority.
+type pool struct {
+	mu      sync.Mutex
+	running int
+	waiting [numPriorities][]chan struct{}
+}
+
+var jobs pool
+
+// stopCtx is the parent of every job context, canceled by CancelJobs
+var stopCtx, stopJobs = context.WithCancel(context.Background())
+
+// CancelJobs kills the running ffprobe/ffmpeg processes and makes queued and
+// future jobs fail, when the server stops
+func CancelJobs() {
+	stopJobs()
+}
+
+// acquire waits for a free slot. When it returns nil the caller owns a slot
+// and must call release. Closing promote moves a queued background job to
+// the interactive queue, see share.
+func (p *pool) acquire(ctx context.Context, prio Priority, promote <-chan struct{}) error {
+	p.mu.Lock()
+	if p.running < config.Get().MaxJobs && !p.queuedBefore(prio) {
+		p.running++
+		p.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	p.waiting[prio] = append(p.waiting[prio], ready)
+	p.mu.Unlock()
+
+	for {
+		select {
+		case <-ready:
+			return nil
+		case <-promote:
+			promote = nil
+			p.mu.Lock()
+			if prio != Interactive && p.dequeue(prio, ready) {
+				prio = Interactive
+				p.waiting[prio] = append(p.waiting[prio], ready)
+			}
+			p.mu.Unlock()
+		case <-ctx.Done():
+			p.mu.Lock()
+			if p.dequeue(prio, ready) {
+				p.mu.Unlock()
+				return ctx.Err()
+			}
+			p.mu.Unlock()
+			// The slot was handed over while we were giving up, pass it on
+			p.release()
+			return ctx.Err()
+		}
+	}
+}
+
+// dequeue removes a waiting job, it reports false if the job already got a
+// slot. Must be called with p.mu held.
+func (p *pool) dequeue(prio Priority, ready chan struct{}) bool {
+	for i, ch := range p.waiting[prio] {
+		if ch == ready {
+			p.waiting[prio] = append(p.waiting[prio][:i], p.waiting[prio][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// queuedBefore reports if jobs of the same or a higher priority are waiting.
+// Must be called with p.mu held.
+func (p *pool) queuedBefore(prio Priority) bool {
+	for i := Priority(0); i <= prio; i++ {
+		if len(p.waiting[i]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// release gives the slot back, it goes to the next queued job unless
+// max_jobs was lowered below the running jobs
+func (p *pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running--
+	p.startQueued()
+}
+
+// startQueued hands the free slots over to the queued jobs, highest priority
+// first. Must be called with p.mu held.
+func (p *pool) startQueued() {
+	for p.running < config.Get().MaxJobs {
+		var next chan struct{}
+		for prio := range p.waiting {
+			if len(p.waiting[prio]) > 0 {
+				next = p.waiting[prio][0]
+				p.waiting[prio] = p.waiting[prio][1:]
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		p.running++
+		close(next)
+	}
+}
+
+// ResizeJobs starts queued jobs after a reload raised max_jobs. A lower
+// limit applies as running jobs end.
+func ResizeJobs() {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	jobs.startQueued()
+}
+
+// PoolStatus describes the ffprobe/ffmpeg jobs currently handled by the pool
+type PoolStatus struct {
+	Running           int `json:"running"`
+	MaxJobs           int `json:"maxJobs"`
+	QueuedInteractive int `json:"queuedInteractive"`
+	QueuedBackground  int `json:"queuedBackground"`
+	Remuxing          int `json:"remuxing"` // Outside of the pool, see RemuxTo
+	MaxRemuxes        int `json:"maxRemuxes"`
+}
+
+// JobStatus returns a snapshot of the job pool
+func JobStatus() PoolStatus {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	return PoolStatus{
+		Running:           jobs.running,
+		MaxJobs:           config.Get().MaxJobs,
+		QueuedInteractive: len(jobs.waiting[Interactive]),
+		QueuedBackground:  len(jobs.waiting[Background]),
+		Remuxing:          int(remuxing.Load()),
+		MaxRemuxes:        config.Get().MaxRemuxes,
+	}
+}
+
+// run waits for a free slot then calls job, with the priority of ctx. The
+// context given to job is canceled with ctx or CancelJobs, and expires after
+// timeout: time spent in the queue is not counted.
+func run(ctx context.Context, timeout time.Duration, job func(ctx context.Context) error) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	defer context.AfterFunc(stopCtx, stop)()
+
+	if err := jobs.acquire(ctx, priority(ctx), promotion(ctx)); err != nil {
+		return err
+	}
+	defer jobs.release()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return job(ctx)
+}
@@ -0,0 +1,181 @@
+package video_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/video/videotest"
+)
+
+// limitJobs sets max_jobs until the end of the test, see videotest.Setup
+func limitJobs(n int) {
+	cfg := *config.Get()
+	cfg.MaxJobs = n
+	config.Set(&cfg)
+}
+
+// waitFor fails the test if cond doesn't hold within a second
+func waitFor(t *testing.T, what string, cond func(video.PoolStatus) bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond(video.JobStatus()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s, pool: %+v", what, video.JobStatus())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// thumbnails generates thumbnails in the background until the end of the test
+type thumbnails struct {
+	t   *testing.T
+	dir string
+	wg  sync.WaitGroup
+}
+
+func newThumbnails(t *testing.T, dir string) *thumbnails {
+	th := &thumbnails{t: t, dir: dir}
+	t.Cleanup(th.wg.Wait)
+	return th
+}
+
+// start requests the thumbnail of a video, created on first use. The test
+// fails on error unless canFail is set.
+func (th *thumbnails) start(ctx context.Context, name string, canFail bool) <-chan struct{} {
+	path := filepath.Join(th.dir, name)
+	if _, err := os.Stat(path); err != nil {
+		videotest.WriteFile(th.t, th.dir, name, 100)
+	}
+	done := make(chan struct{})
+	th.wg.Go(func() {
+		defer close(done)
+		if _, err := video.Thumbnail(ctx, path); err != nil && !canFail {
+			th.t.Errorf("Thumbnail(%s) = %v", name, err)
+		}
+	})
+	return done
+}
+
+func TestJobPriorities(t *testing.T) {
+	fake := videotest.New()
+	fake.Gate = make(chan struct{})
+	th := newThumbnails(t, videotest.Setup(t, fake))
+	limitJobs(1)
+	background := video.WithPriority(t.Context(), video.Background)
+
+	th.start(t.Context(), "a.mp4", false)
+	waitFor(t, "a to run", func(s video.PoolStatus) bool { return s.Running == 1 })
+	th.start(background, "b1.mp4", false)
+	waitFor(t, "b1 to queue", func(s video.PoolStatus) bool { return s.QueuedBackground == 1 })
+	th.start(background, "b2.mp4", false)
+	waitFor(t, "b2 to queue", func(s video.PoolStatus) bool { return s.QueuedBackground == 2 })
+	th.start(t.Context(), "i.mp4", false)
+	waitFor(t, "i to queue", func(s video.PoolStatus) bool { return s.QueuedInteractive == 1 })
+
+	close(fake.Gate)
+	th.wg.Wait()
+	// The interactive job goes first, background jobs keep their order
+	if got, want := strings.Join(fake.Order(), " "), "a.mp4 i.mp4 b1.mp4 b2.mp4"; got != want {
+		t.Errorf("jobs ran in order %s, want %s", got, want)
+	}
+}
+
+func TestJobPromotion(t *testing.T) {
+	fake := videotest.New()
+	fake.Gate = make(chan struct{})
+	th := newThumbnails(t, videotest.Setup(t, fake))
+	limitJobs(1)
+	background := video.WithPriority(t.Context(), video.Background)
+
+	th.start(t.Context(), "a.mp4", false)
+	waitFor(t, "a to run", func(s video.PoolStatus) bool { return s.Running == 1 })
+	th.start(background, "c.mp4", false)
+	waitFor(t, "c to queue", func(s video.PoolStatus) bool { return s.QueuedBackground == 1 })
+	th.start(background, "b.mp4", false)
+	waitFor(t, "b to queue", func(s video.PoolStatus) bool { return s.QueuedBackground == 2 })
+
+	// A screen opens the folder of b while the indexer waits for it
+	th.start(t.Context(), "b.mp4", false)
+	waitFor(t, "b to be promoted", func(s video.PoolStatus) bool {
+		return s.QueuedInteractive == 1 && s.QueuedBackground == 1
+	})
+
+	close(fake.Gate)
+	th.wg.Wait()
+	if got, want := strings.Join(fake.Order(), " "), "a.mp4 b.mp4 c.mp4"; got != want {
+		t.Errorf("jobs ran in order %s, want %s", got, want)
+	}
+}
+
+func TestJobSlotHandoff(t *testing.T) {
+	fake := videotest.New()
+	th := newThumbnails(t, videotest.Setup(t, fake))
+	limitJobs(1)
+
+	// A queued job canceled as the slot is handed to it must pass it on,
+	// whichever happens first
+	for i := range 100 {
+		fake.Gate = make(chan struct{})
+		th.start(t.Context(), fmt.Sprintf("running-%d.mp4", i), false)
+		waitFor(t, "the first job to run", func(s video.PoolStatus) bool { return s.Running == 1 })
+		ctx, cancel := context.WithCancel(t.Context())
+		th.start(ctx, fmt.Sprintf("canceled-%d.mp4", i), true)
+		waitFor(t, "a job to queue", func(s video.PoolStatus) bool { return s.QueuedInteractive == 1 })
+		next := th.start(t.Context(), fmt.Sprintf("next-%d.mp4", i), false)
+		waitFor(t, "the next job to queue", func(s video.PoolStatus) bool { return s.QueuedInteractive == 2 })
+
+		cancel()
+		// Give up to 100µs to the canceled job before the slot frees
+		time.Sleep(time.Duration(i%20) * 5 * time.Microsecond)
+		close(fake.Gate)
+		select {
+		case <-next:
+		case <-time.After(time.Second):
+			t.Fatalf("the job queued after a canceled one never ran, pool: %+v", video.JobStatus())
+		}
+		waitFor(t, "the slots to be free", func(s video.PoolStatus) bool {
+			return s.Running == 0 && s.QueuedInteractive == 0
+		})
+	}
+}
+
+func TestResizeJobs(t *testing.T) {
+	fake := videotest.New()
+	fake.Gate = make(chan struct{})
+	th := newThumbnails(t, videotest.Setup(t, fake))
+	limitJobs(1)
+
+	for _, name := range []string{"a.mp4", "b.mp4", "c.mp4"} {
+		th.start(t.Context(), name, false)
+	}
+	waitFor(t, "a to run", func(s video.PoolStatus) bool { return s.Running == 1 && s.QueuedInteractive == 2 })
+
+	// A reload raises max_jobs: the queued jobs start at once
+	limitJobs(3)
+	video.ResizeJobs()
+	waitFor(t, "b and c to run", func(s video.PoolStatus) bool { return s.Running == 3 && s.QueuedInteractive == 0 })
+
+	// It lowers it: d waits until the running jobs are under the new limit
+	limitJobs(1)
+	th.start(t.Context(), "d.mp4", false)
+	waitFor(t, "d to queue", func(s video.PoolStatus) bool { return s.QueuedInteractive == 1 })
+	for running := 2; running > 0; running-- {
+		fake.Gate <- struct{}{}
+		waitFor(t, "a job to end", func(s video.PoolStatus) bool { return s.Running == running })
+		if n := video.JobStatus().QueuedInteractive; n != 1 {
+			t.Fatalf("%d jobs queued with %d running, want d still queued", n, running)
+		}
+	}
+	fake.Gate <- struct{}{}
+	waitFor(t, "d to run", func(s video.PoolStatus) bool { return s.Running == 1 && s.QueuedInteractive == 0 })
+	close(fake.Gate)
+	th.wg.Wait()
+}
@@ -1,41 +1,97 @@
 package video
 
 import (
+	"context"
+	"errors"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 
 	"wallplayer/pkg/config"
 )
 
-// GenerateThumbnail generates a thumbnail for a video
-// Returns the path to the generated thumbnail or path to no-preview image if generation fails
-func GenerateThumbnail(videoPath string) (string, error) {
+var errNoThumbnail = errors.New("ffmpeg produced an empty thumbnail")
+
+// Thumbnail returns the path of the thumbnail for a video, generating it only
+// if there is no cached thumbnail newer than the video. Generation stops when
+// ctx ends, unless other requests wait for the same thumbnail.
+func Thumbnail(ctx context.Context, videoPath string) (string, error) {
 	// Check if video file exists
-	if _, err := os.Stat(videoPath); os.IsNotExist(err) {
-		return "/static/img/no-preview.jpg", nil
+	stat, err := os.Stat(videoPath)
+	if err != nil {
+		return "", err
 	}
 
 	// Use generated thumbnails directory
-	thumbPath := filepath.Join(config.ThumbnailsDir, filepath.Base(videoPath)+".jpg")
-
-	// Generate thumbnail using ffmpeg with the following arguments:
-	cmd := exec.Command("ffmpeg",
-		"-v", "error", // Only show errors in output
-		"-ss", "10", // Seek to 1o second (avoid black frames at start)
-		"-i", videoPath, // Input file
-		"-frames:v", "1", // Extract exactly one frame
-		"-q:v", "2", // Quality factor (2-31, lower is better quality)
-		"-vf", "scale=320:-1", // Scale width to 320px, height auto (-1)
-		"-y",      // Overwrite output file if exists
-		thumbPath, // Output file path
-	)
-
-	if err := cmd.Run(); err != nil {
+	key := artifactKey(videoPath, stat)
+	thumbPath := filepath.Join(config.Get().ThumbnailsDir(), key+".jpg")
+	if upToDate(thumbPath, stat) {
+		return thumbPath, nil
+	}
+	return share(ctx, "thumbnail/"+key, func(ctx context.Context) (string, error) {
+		return generateThumbnail(ctx, videoPath, stat, key, thumbPath)
+	})
+}
+
+// Prepare fills the metadata cache and generates the thumbnail and subtitles
+// of a video as background work, so the first screen opening its folder
+// doesn't wait and subtitles can be searched
+func Prepare(ctx context.Context, videoPath string) error {
+	ctx = WithPriority(ctx, Background)
+	info, err := GetInfo(ctx, videoPath)
+	if err != nil {
+		return err
+	}
+	for _, sub := range info.Subtitles {
+		if _, err := EnsureSubtitle(ctx, videoPath, sub.Language); err != nil {
+			log.Printf("Error extracting %s subtitles of %s: %v", sub.Language, videoPath, err)
+		}
+	}
+	_, err = Thumbnail(ctx, videoPath)
+	return err
+}
+
+// upToDate reports if a generated thumbnail is newer than its video
+func upToDate(thumbPath string, stat os.FileInfo) bool {
+	thumb, err := os.Stat(thumbPath)
+	return err == nil && thumb.Size() > 0 && !thumb.ModTime().Before(stat.ModTime())
+}
+
+func generateThumbnail(ctx context.Context, videoPath string, stat os.FileInfo, key, thumbPath string) (string, error) {
+	// Reuse the thumbnail generated by a job that just finished
+	if upToDate(thumbPath, stat) {
+		return thumbPath, nil
+	}
+	if hasFailed(key + ".jpg") {
+		return "", errNoThumbnail
+	}
+	removeStale(config.Get().ThumbnailsDir(), key)
+
+	// Write to a temporary file so a thumbnail being generated is never served
+	tmp, err := os.CreateTemp(config.Get().ThumbnailsDir(), key+".*.jpg")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	cfg := config.Get()
+	err = run(ctx, cfg.JobTimeout, func(ctx context.Context) error {
+		return Transcoder.Thumbnail(ctx, videoPath, tmp.Name(), cfg.ThumbnailSeek, cfg.ThumbnailWidth)
+	})
+	if err != nil {
 		log.Printf("Error generating thumbnail for %s: %v", videoPath, err)
-		return "/static/img/no-preview.jpg", nil
+		return "", err
+	}
+
+	// ffmpeg succeeds without output when seeking past the end of short videos
+	if info, err := os.Stat(tmp.Name()); err != nil || info.Size() == 0 {
+		markFailed(key + ".jpg")
+		return "", errNoThumbnail
 	}
 
-	return "/thumbnails/" + filepath.Base(thumbPath), nil
+	if err := os.Rename(tmp.Name(), thumbPath); err != nil {
+		return "", err
+	}
+	return thumbPath, nil
 }
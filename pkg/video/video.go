@@ -1,31 +1,18 @@
 package video
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
-	"sync"
-	"time"
-
-	"github.com/vansante/go-ffprobe"
 
 	"wallplayer/pkg/config"
 )
 
-type cacheEntry struct {
-	info      *VideoInfo
-	timestamp time.Time
-}
-
-var (
-	cache     = make(map[string]cacheEntry)
-	cacheLock sync.RWMutex
-	// Cache for 1 hour
-	cacheDuration = 1 * time.Hour
-)
-
 var Extensions = map[string]bool{
 	".mp4":  true,
 	".webm": true,
@@ -35,9 +22,14 @@ var Extensions = map[string]bool{
 	".m4v":  true,
 }
 
+// IsVideo reports if a file name has a video extension, from the
+// configuration or Extensions if none are configured
 func IsVideo(path string) bool {
-	ext := filepath.Ext(path)
-	return Extensions[strings.ToLower(ext)]
+	ext := strings.ToLower(filepath.Ext(path))
+	if configured := config.Get().Extensions; len(configured) > 0 {
+		return slices.Contains(configured, ext)
+	}
+	return Extensions[ext]
 }
 
 type SubtitleInfo struct {
@@ -48,93 +40,97 @@ type SubtitleInfo struct {
 }
 
 type VideoInfo struct {
-	Duration  float64        `json:"duration"` // in seconds
-	Width     int            `json:"width"`
-	Height    int            `json:"height"`
-	Bitrate   int64          `json:"bitrate"`
-	Format    string         `json:"format"`
-	Subtitles []SubtitleInfo `json:"subtitles,omitempty"`
+	Duration    float64        `json:"duration"` // in seconds
+	Width       int            `json:"width"`
+	Height      int            `json:"height"`
+	Bitrate     int64          `json:"bitrate"`
+	Format      string         `json:"format"`
+	VideoCodec  string         `json:"videoCodec,omitempty"`  // ffprobe codec name, e.g. h264
+	PixelFormat string         `json:"pixelFormat,omitempty"` // e.g. yuv420p, 10 bits formats are not played by browsers
+	AudioCodec  string         `json:"audioCodec,omitempty"`  // Empty without audio
+	Subtitles   []SubtitleInfo `json:"subtitles,omitempty"`
 }
 
-func GetInfo(path string) (*VideoInfo, error) {
-	// Check the cache
-	cacheLock.RLock()
-	if entry, ok := cache[path]; ok {
-		if time.Since(entry.timestamp) < cacheDuration {
-			cacheLock.RUnlock()
-			return entry.info, nil
-		}
-	}
-	cacheLock.RUnlock()
-
-	// If not in cache or expired, load from file
-	data, err := ffprobe.GetProbeData(path, 3*time.Second)
+// GetInfo returns the metadata of a video, probing it with ffprobe if needed.
+// Concurrent calls for the same video share one ffprobe.
+func GetInfo(ctx context.Context, path string) (*VideoInfo, error) {
+	stat, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
-	bitrate := int64(0)
-	if data.Format.BitRate != "" {
-		fmt.Sscanf(data.Format.BitRate, "%d", &bitrate)
+	// Check the cache, entries are only valid for an unchanged file
+	if info, ok := getCached(path, stat); ok {
+		return info, nil
 	}
+	return share(ctx, "info/"+path, func(ctx context.Context) (*VideoInfo, error) {
+		return probe(ctx, path, stat)
+	})
+}
 
-	info := &VideoInfo{
-		Duration: data.Format.DurationSeconds,
-		Format:   data.Format.FormatName,
-		Bitrate:  bitrate,
+func probe(ctx context.Context, path string, stat os.FileInfo) (*VideoInfo, error) {
+	// Probed by a job that just finished
+	if info, ok := getCached(path, stat); ok {
+		return info, nil
 	}
 
-	// Store in cache
-	cacheLock.Lock()
-	cache[path] = cacheEntry{
-		info:      info,
-		timestamp: time.Now(),
-	}
-	cacheLock.Unlock()
-
-	// Get video and subtitle stream info
-	for _, stream := range data.Streams {
-		switch stream.CodecType {
-		case "video":
-			info.Width = stream.Width
-			info.Height = stream.Height
-		case "subtitle":
-			lang := "und"
-			if stream.Tags.Language != "" {
-				lang = stream.Tags.Language
-			}
-
-			subtitle := SubtitleInfo{
-				StreamIndex: stream.Index,
-				Codec:       stream.CodecName,
-				Language:    lang,
-			}
-
-			info.Subtitles = append(info.Subtitles, subtitle)
-		}
+	// If not in cache or file changed, load from file
+	var info *VideoInfo
+	err := run(ctx, config.Get().ProbeTimeout, func(ctx context.Context) error {
+		var err error
+		info, err = Prober.Probe(ctx, path)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	// Store in cache
+	putCached(path, stat, info)
+
 	return info, nil
 }
 
 // GetSubtitlePath returns the path where a subtitle file for the given video and language should be stored
-func GetSubtitlePath(videoPath, language string) string {
-	baseName := filepath.Base(videoPath[:len(videoPath)-len(filepath.Ext(videoPath))])
-	return filepath.Join(config.SubtitlesDir, fmt.Sprintf("%s_%s.vtt", baseName, language))
+func GetSubtitlePath(videoPath, language string) (string, error) {
+	stat, err := os.Stat(videoPath)
+	if err != nil {
+		return "", err
+	}
+	return subtitleFile(artifactKey(videoPath, stat), language), nil
+}
+
+func subtitleFile(key, language string) string {
+	return filepath.Join(config.Get().SubtitlesDir(), fmt.Sprintf("%s_%s.vtt", key, filepath.Base(language)))
 }
 
 // EnsureSubtitle ensures subtitle file exists for the given video and language, extracting it if needed.
 // Returns the path to the subtitle file or an error.
-func EnsureSubtitle(videoPath, language string) (string, error) {
-	subtitlePath := GetSubtitlePath(videoPath, language)
+func EnsureSubtitle(ctx context.Context, videoPath, language string) (string, error) {
+	stat, err := os.Stat(videoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get video info: %w", err)
+	}
+	key := artifactKey(videoPath, stat)
+	subtitlePath := subtitleFile(key, language)
 
 	// Check if subtitle already exists
 	if _, err := os.Stat(subtitlePath); err == nil {
 		return subtitlePath, nil
 	}
+	return share(ctx, "subtitle/"+filepath.Base(subtitlePath), func(ctx context.Context) (string, error) {
+		return ensureSubtitle(ctx, videoPath, language, key, subtitlePath)
+	})
+}
+
+func ensureSubtitle(ctx context.Context, videoPath, language, key, subtitlePath string) (string, error) {
+	// Extracted by a job that just finished
+	if _, err := os.Stat(subtitlePath); err == nil {
+		return subtitlePath, nil
+	}
 
 	// Get video info to find stream index for this language
-	info, err := GetInfo(videoPath)
+	info, err := GetInfo(ctx, videoPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to get video info: %w", err)
 	}
@@ -151,42 +147,51 @@ func EnsureSubtitle(videoPath, language string) (string, error) {
 		return "", fmt.Errorf("no subtitle found for language %s", language)
 	}
 
-	// Extract subtitle
-	if err := ExtractSubtitle(videoPath, streamIndex, subtitlePath); err != nil {
+	// Extract subtitle, dropping files extracted from a previous version of the video
+	name := filepath.Base(subtitlePath)
+	if hasFailed(name) {
+		return "", fmt.Errorf("failed to extract subtitle: previous extraction failed")
+	}
+	removeStale(config.Get().SubtitlesDir(), key)
+	if err := ExtractSubtitle(ctx, videoPath, streamIndex, subtitlePath); err != nil {
+		// ffmpeg exited on its own, it would fail the same way next time
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			markFailed(name)
+		}
 		return "", fmt.Errorf("failed to extract subtitle: %w", err)
 	}
 
 	return subtitlePath, nil
 }
 
-// ExtractSubtitle extracts a subtitle stream from a video file and saves it as WebVTT
-func ExtractSubtitle(videoPath string, streamIndex int, outputPath string) error {
+// ExtractSubtitle extracts a subtitle stream from a video file and saves it as
+// WebVTT. ffmpeg is killed when ctx ends, the output file is only created on success.
+func ExtractSubtitle(ctx context.Context, videoPath string, streamIndex int, outputPath string) error {
 	// Ensure the output directory exists
 	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Build ffmpeg command to extract directly to WebVTT
-	args := []string{
-		"-i", videoPath,
-		"-map", fmt.Sprintf("0:%d", streamIndex),
-		"-f", "webvtt",
-		"-c:s", "webvtt",
-		outputPath,
+	// Write to a temporary file so a partial subtitle is never served
+	base := strings.TrimSuffix(filepath.Base(outputPath), ".vtt")
+	tmp, err := os.CreateTemp(filepath.Dir(outputPath), base+".*.vtt")
+	if err != nil {
+		return err
 	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
 
-	// Execute ffmpeg command to extract subtitles
-	cmd := exec.Command("ffmpeg", args...)
-	// Suppress ffmpeg stderr output
-	if err := cmd.Run(); err != nil {
+	err = run(ctx, config.Get().JobTimeout, func(ctx context.Context) error {
+		return Transcoder.Subtitle(ctx, videoPath, streamIndex, tmp.Name())
+	})
+	if err != nil {
 		return fmt.Errorf("failed to extract subtitles: %w", err)
 	}
 
 	// Check if extraction produced a non-empty file
-	if stat, err := os.Stat(outputPath); os.IsNotExist(err) || stat.Size() == 0 {
-		os.Remove(outputPath) // Clean up empty file
+	if stat, err := os.Stat(tmp.Name()); err != nil || stat.Size() == 0 {
 		return fmt.Errorf("failed to extract subtitles or empty subtitle stream")
 	}
-
-	return nil
+	return os.Rename(tmp.Name(), outputPath)
 }
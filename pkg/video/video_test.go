@@ -0,0 +1,440 @@
+package video_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/video"
+	"wallplayer/pkg/video/videotest"
+)
+
+func TestGetInfo(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "talk.mkv", 100)
+	fake.Infos["talk.mkv"] = &video.VideoInfo{Duration: 42, Width: 640, Height: 360}
+
+	for range 3 {
+		info, err := video.GetInfo(t.Context(), path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Duration != 42 || info.Height != 360 {
+			t.Fatalf("GetInfo = %+v, want the canned info", info)
+		}
+	}
+	if n := fake.Calls("Probe"); n != 1 {
+		t.Errorf("probed %d times, want 1: the result is cached", n)
+	}
+
+	// A modified file is probed again
+	videotest.WriteFile(t, dir, "talk.mkv", 200)
+	if _, err := video.GetInfo(t.Context(), path); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Calls("Probe"); n != 2 {
+		t.Errorf("probed %d times after a change, want 2", n)
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	kept := videotest.WriteFile(t, dir, "kept.mkv", 100)
+	gone := videotest.WriteFile(t, dir, "gone.mkv", 100)
+	for _, path := range []string{kept, gone} {
+		if _, err := video.GetInfo(t.Context(), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// gone.mkv was renamed while nothing watched the library
+	video.PruneCache([]string{kept}, nil)
+	for _, path := range []string{kept, gone} {
+		if _, err := video.GetInfo(t.Context(), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fake.Calls("Probe"); n != 3 {
+		t.Errorf("probed %d times, want 3: only the pruned video is probed again", n)
+	}
+
+	// Entries of a library that couldn't be read are kept
+	video.PruneCache(nil, []string{dir})
+	if _, err := video.GetInfo(t.Context(), kept); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Calls("Probe"); n != 3 {
+		t.Errorf("probed %d times, want 3: nothing is pruned", n)
+	}
+}
+
+func TestGetInfoMissing(t *testing.T) {
+	dir := videotest.Setup(t, videotest.New())
+	_, err := video.GetInfo(t.Context(), dir+"/missing.mp4")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("GetInfo of a missing file = %v, want ErrNotExist", err)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "a/clip.mp4", 100)
+
+	thumb, err := video.Thumbnail(t.Context(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := jpeg.DecodeConfig(file)
+	if err != nil {
+		t.Fatalf("thumbnail is not a JPEG: %v", err)
+	}
+	if img.Width != 320 {
+		t.Errorf("thumbnail width = %d, want 320", img.Width)
+	}
+
+	again, err := video.Thumbnail(t.Context(), path)
+	if err != nil || again != thumb {
+		t.Errorf("second Thumbnail = %q, %v, want %q", again, err, thumb)
+	}
+	if n := fake.Calls("Thumbnail"); n != 1 {
+		t.Errorf("generated %d times, want 1: the thumbnail is reused", n)
+	}
+}
+
+func TestThumbnailShared(t *testing.T) {
+	fake := videotest.New()
+	fake.Delay = 100 * time.Millisecond
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "clip.mp4", 100)
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Go(func() {
+			if _, err := video.Thumbnail(t.Context(), path); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if n := fake.Calls("Thumbnail"); n != 1 {
+		t.Errorf("5 concurrent requests generated %d times, want 1", n)
+	}
+}
+
+func TestThumbnailCanceled(t *testing.T) {
+	fake := videotest.New()
+	fake.Delay = time.Hour
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "clip.mp4", 100)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := video.Thumbnail(ctx, path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Thumbnail = %v, want the error of the context", err)
+	}
+
+	// The job is canceled and gives its slot back
+	deadline := time.Now().Add(time.Second)
+	for video.JobStatus().Running > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the job still runs after its only request left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestThumbnailFailure(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "broken.mp4", 100)
+	fake.Errors["broken.mp4"] = errors.New("invalid data found when processing input")
+
+	if _, err := video.Thumbnail(t.Context(), path); err == nil {
+		t.Fatal("Thumbnail of a broken video succeeded")
+	}
+	// The temporary output file is removed
+	entries, err := os.ReadDir(config.Get().ThumbnailsDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("thumbnails directory holds %s after a failure", entries[0].Name())
+	}
+}
+
+func TestEnsureSubtitle(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "film.mkv", 100)
+	fake.Infos["film.mkv"] = &video.VideoInfo{
+		Duration: 60,
+		Subtitles: []video.SubtitleInfo{
+			{Language: "eng", StreamIndex: 2, Codec: "subrip"},
+			{Language: "fre", StreamIndex: 3, Codec: "subrip"},
+		},
+	}
+
+	sub, err := video.EnsureSubtitle(t.Context(), path, "fre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "WEBVTT") || !strings.Contains(string(data), "Stream 3 of film.mkv") {
+		t.Errorf("subtitle file = %q, want stream 3 as WebVTT", data)
+	}
+	if want, _ := video.GetSubtitlePath(path, "fre"); sub != want {
+		t.Errorf("subtitle path = %q, want %q", sub, want)
+	}
+
+	if _, err := video.EnsureSubtitle(t.Context(), path, "fre"); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Calls("Subtitle"); n != 1 {
+		t.Errorf("extracted %d times, want 1", n)
+	}
+
+	if _, err := video.EnsureSubtitle(t.Context(), path, "ger"); err == nil {
+		t.Error("EnsureSubtitle of a missing language succeeded")
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "film.mkv", 100)
+	fake.Infos["film.mkv"] = &video.VideoInfo{
+		Subtitles: []video.SubtitleInfo{{Language: "eng", StreamIndex: 2}},
+	}
+
+	if err := video.Prepare(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{"Probe", "Thumbnail", "Subtitle"} {
+		if n := fake.Calls(method); n != 1 {
+			t.Errorf("%s called %d times, want 1", method, n)
+		}
+	}
+}
+
+func TestPlaybackOf(t *testing.T) {
+	h264 := &video.VideoInfo{VideoCodec: "h264", PixelFormat: "yuv420p", AudioCodec: "aac"}
+	tests := []struct {
+		path string
+		info *video.VideoInfo
+		want video.Playback
+	}{
+		{"a.mp4", h264, video.Direct},
+		{"a.mp4", nil, video.Direct},
+		{"a.webm", &video.VideoInfo{VideoCodec: "vp9", AudioCodec: "opus"}, video.Direct},
+		{"a.mp4", &video.VideoInfo{Duration: 60, VideoCodec: "hevc", PixelFormat: "yuv420p", AudioCodec: "aac"}, video.HLS},
+		{"a.MOV", &video.VideoInfo{Duration: 60, VideoCodec: "prores", PixelFormat: "yuv422p10le", AudioCodec: "pcm_s16le"}, video.HLS},
+		{"a.mov", &video.VideoInfo{Duration: 60, VideoCodec: "h264", PixelFormat: "yuv420p", AudioCodec: "pcm_s16le"}, video.HLS},
+		{"a.mp4", &video.VideoInfo{Duration: 60, VideoCodec: "h264", PixelFormat: "yuv420p10le", AudioCodec: "aac"}, video.HLS},
+		{"a.mp4", &video.VideoInfo{VideoCodec: "hevc"}, video.Direct}, // Unknown duration
+		{"a.MKV", h264, video.Remux},
+		{"a.avi", &video.VideoInfo{VideoCodec: "h264", PixelFormat: "yuv420p", AudioCodec: "mp3"}, video.Remux},
+		{"a.mkv", &video.VideoInfo{VideoCodec: "h264"}, video.Remux}, // No audio
+		{"a.mkv", &video.VideoInfo{Duration: 60, VideoCodec: "hevc", AudioCodec: "aac"}, video.HLS},
+		{"a.mkv", &video.VideoInfo{Duration: 60, VideoCodec: "h264", PixelFormat: "yuv420p10le"}, video.HLS},
+		{"a.avi", &video.VideoInfo{Duration: 60, VideoCodec: "mpeg4", AudioCodec: "mp3"}, video.HLS},
+		{"a.mkv", &video.VideoInfo{Duration: 60, VideoCodec: "h264", AudioCodec: "dts"}, video.HLS},
+		{"a.mkv", &video.VideoInfo{VideoCodec: "hevc"}, video.Direct}, // Unknown duration
+		{"a.mkv", nil, video.Direct}, // Probe failed
+	}
+	for _, test := range tests {
+		if got := video.PlaybackOf(test.path, test.info); got != test.want {
+			t.Errorf("PlaybackOf(%s, %+v) = %s, want %s", test.path, test.info, got, test.want)
+		}
+	}
+}
+
+func TestHLSPlaylist(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "film.mkv", 100)
+	fake.Infos["film.mkv"] = &video.VideoInfo{Duration: 15.5}
+
+	playlist, err := video.HLSPlaylist(t.Context(), path, "480p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"#EXTM3U\n",
+		"#EXT-X-TARGETDURATION:6\n",
+		"#EXTINF:6.000,\nsegment-0.ts\n#EXTINF:6.000,\nsegment-1.ts\n#EXTINF:3.500,\nsegment-2.ts\n#EXT-X-ENDLIST\n",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist = %q, want it to contain %q", playlist, want)
+		}
+	}
+}
+
+func TestRenditions(t *testing.T) {
+	tests := []struct {
+		info *video.VideoInfo
+		want string
+	}{
+		{&video.VideoInfo{Height: 2160, Bitrate: 40_000_000}, "1080p:5000000 720p:2800000 480p:1200000"},
+		{&video.VideoInfo{Height: 1080, Bitrate: 8_000_000}, "1080p:5000000 720p:2800000 480p:1200000"},
+		{&video.VideoInfo{Height: 800, Bitrate: 2_000_000}, "720p:2000000 480p:1200000"}, // Capped to the source
+		{&video.VideoInfo{Height: 1080, Bitrate: 1_000_000}, "1080p:1000000"},            // Lower ones save nothing
+		{&video.VideoInfo{Height: 360, Bitrate: 600_000}, "360p:600000"},
+		{&video.VideoInfo{}, "1080p:5000000 720p:2800000 480p:1200000"}, // Unknown size
+	}
+	for _, test := range tests {
+		var got []string
+		for _, r := range video.Renditions(test.info) {
+			got = append(got, fmt.Sprintf("%s:%d", r.Name, r.VideoBitrate))
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("Renditions(%+v) = %v, want %s", test.info, got, test.want)
+		}
+	}
+}
+
+func TestHLSMasterPlaylist(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "film.mkv", 100)
+	fake.Infos["film.mkv"] = &video.VideoInfo{Duration: 60, Width: 1920, Height: 800, Bitrate: 2_000_000}
+
+	playlist, err := video.HLSMasterPlaylist(t.Context(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2128000,RESOLUTION=1728x720\n720p/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1328000,RESOLUTION=1152x480\n480p/index.m3u8\n"
+	if playlist != want {
+		t.Errorf("master playlist = %q, want %q", playlist, want)
+	}
+
+	if _, err := video.HLSPlaylist(t.Context(), path, "1080p"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("playlist of a rendition larger than the video = %v, want ErrNotExist", err)
+	}
+}
+
+func TestHLSSegment(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	path := videotest.WriteFile(t, dir, "film.mkv", 100)
+	fake.Infos["film.mkv"] = &video.VideoInfo{Duration: 20, Width: 1920, Height: 1080, Bitrate: 8_000_000}
+
+	// Seeking: segment 1 is encoded without segment 0
+	segment, err := video.HLSSegment(t.Context(), path, "720p", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := video.SegmentOptions{Start: 6 * time.Second, Duration: 6 * time.Second, Height: 720, VideoBitrate: 2_800_000}
+	if want := videotest.SegmentOutput(path, opts); string(data) != want {
+		t.Errorf("segment = %q, want %q", data, want)
+	}
+
+	// Segments 2 and 3 (2s) are encoded ahead
+	deadline := time.Now().Add(time.Second)
+	for fake.Calls("Segment") < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("encoded %d segments, want the next ones encoded ahead", fake.Calls("Segment"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for n := 1; n <= 3; n++ {
+		if _, err := video.HLSSegment(t.Context(), path, "720p", n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fake.Calls("Segment"); n != 3 {
+		t.Errorf("encoded %d times, want 3: segments are reused", n)
+	}
+
+	// Renditions have their own segments
+	other, err := video.HLSSegment(t.Context(), path, "480p", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == segment {
+		t.Errorf("480p and 720p share the segment %s", segment)
+	}
+
+	for _, n := range []int{-1, 4} {
+		if _, err := video.HLSSegment(t.Context(), path, "720p", n); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("HLSSegment(%d) = %v, want ErrNotExist", n, err)
+		}
+	}
+	if _, err := video.HLSSegment(t.Context(), path, "240p", 0); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("HLSSegment of an unknown rendition = %v, want ErrNotExist", err)
+	}
+
+	// Closing waits for the prefetches of the 480p segments
+	video.CloseHLSSessions(0)
+	if n := video.JobStatus().Running; n != 0 {
+		t.Errorf("%d jobs still running after closing the sessions", n)
+	}
+
+	// The segments are kept for the next plays
+	calls := fake.Calls("Segment")
+	again, err := video.HLSSegment(t.Context(), path, "720p", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != segment {
+		t.Errorf("segment moved to %s after closing the sessions, want %s", again, segment)
+	}
+	video.CloseHLSSessions(0)
+	if n := fake.Calls("Segment"); n != calls {
+		t.Errorf("encoded %d times after closing the sessions, want the segments reused", n-calls)
+	}
+}
+
+func TestPruneHLSSegments(t *testing.T) {
+	fake := videotest.New()
+	dir := videotest.Setup(t, fake)
+	fake.Infos["old.mkv"] = &video.VideoInfo{Duration: 5, Width: 1280, Height: 720}
+	fake.Infos["new.mkv"] = &video.VideoInfo{Duration: 5, Width: 1280, Height: 720}
+
+	var segments []string
+	for _, name := range []string{"old.mkv", "new.mkv"} {
+		segment, err := video.HLSSegment(t.Context(), videotest.WriteFile(t, dir, name, 100), "720p", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, segment)
+	}
+	video.CloseHLSSessions(0)
+	// old.mkv was last played a week ago
+	week := time.Now().Add(-7 * 24 * time.Hour)
+	if err := os.Chtimes(filepath.Dir(filepath.Dir(segments[0])), week, week); err != nil {
+		t.Fatal(err)
+	}
+
+	video.PruneHLSSegments(24 * time.Hour)
+	if _, err := os.Stat(segments[0]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("segment of a video not played for a week still exists: %v", err)
+	}
+	if _, err := os.Stat(segments[1]); err != nil {
+		t.Errorf("segment of a video just played was deleted: %v", err)
+	}
+}
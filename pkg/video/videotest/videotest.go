@@ -0,0 +1,210 @@
+// Package videotest replaces ffprobe and ffmpeg with an in-process fake, so
+// packages built on video can be tested without the binaries.
+package videotest
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"wallplayer/pkg/browse"
+	"wallplayer/pkg/config"
+	"wallplayer/pkg/video"
+)
+
+// DefaultInfo is returned by Fake.Probe for files not in Fake.Infos
+var DefaultInfo = video.VideoInfo{
+	Duration:    90,
+	Width:       1920,
+	Height:      1080,
+	Bitrate:     4000000,
+	Format:      "mov,mp4,m4a,3gp,3g2,mj2",
+	VideoCodec:  "h264",
+	PixelFormat: "yuv420p",
+	AudioCodec:  "aac",
+}
+
+// Fake implements video.MediaProber and video.MediaTranscoder. Like ffmpeg,
+// it fails on missing files and stops when its context ends.
+type Fake struct {
+	Infos  map[string]*video.VideoInfo // By file name
+	Errors map[string]error            // By file name, returned by every call
+	Delay  time.Duration               // Run time of every call
+	Gate   chan struct{}               // When set, every call waits for a value or for Gate to be closed
+
+	mu    sync.Mutex
+	calls map[string]int
+	order []string
+}
+
+// New returns a fake answering DefaultInfo for every video
+func New() *Fake {
+	return &Fake{
+		Infos:  make(map[string]*video.VideoInfo),
+		Errors: make(map[string]error),
+		calls:  make(map[string]int),
+	}
+}
+
+// Calls returns the number of calls of a method: "Probe", "Thumbnail", "Subtitle", "Remux" or "Segment"
+func (f *Fake) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// Order returns the file names of the videos of all calls, in the order
+// they started
+func (f *Fake) Order() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.order...)
+}
+
+// start records a call and waits for Gate and Delay
+func (f *Fake) start(ctx context.Context, method, videoPath string) error {
+	f.mu.Lock()
+	f.calls[method]++
+	f.order = append(f.order, filepath.Base(videoPath))
+	err := f.Errors[filepath.Base(videoPath)]
+	f.mu.Unlock()
+
+	if _, statErr := os.Stat(videoPath); statErr != nil {
+		return statErr
+	}
+	if f.Gate != nil {
+		select {
+		case <-f.Gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case <-time.After(f.Delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return err
+}
+
+func (f *Fake) Probe(ctx context.Context, path string) (*video.VideoInfo, error) {
+	if err := f.start(ctx, "Probe", path); err != nil {
+		return nil, err
+	}
+	info := DefaultInfo
+	if canned, ok := f.Infos[filepath.Base(path)]; ok {
+		info = *canned
+	}
+	return &info, nil
+}
+
+// Thumbnail writes a grey JPEG of width pixels with a 16:9 aspect ratio
+func (f *Fake) Thumbnail(ctx context.Context, videoPath, outputPath string, seek time.Duration, width int) error {
+	if err := f.start(ctx, "Thumbnail", videoPath); err != nil {
+		return err
+	}
+	img := image.NewGray(image.Rect(0, 0, width, width*9/16))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, img, nil); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Subtitle writes a WebVTT file with one cue naming the stream and the video
+func (f *Fake) Subtitle(ctx context.Context, videoPath string, streamIndex int, outputPath string) error {
+	if err := f.start(ctx, "Subtitle", videoPath); err != nil {
+		return err
+	}
+	vtt := fmt.Sprintf("WEBVTT\n\n00:00:01.000 --> 00:00:04.000\nStream %d of %s\n", streamIndex, filepath.Base(videoPath))
+	return os.WriteFile(outputPath, []byte(vtt), 0644)
+}
+
+// Remux writes RemuxOutput of the video
+func (f *Fake) Remux(ctx context.Context, videoPath string, w io.Writer) error {
+	if err := f.start(ctx, "Remux", videoPath); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, RemuxOutput(videoPath))
+	return err
+}
+
+// RemuxOutput is the stream written by Fake.Remux
+func RemuxOutput(videoPath string) string {
+	return "fragmented MP4 of " + filepath.Base(videoPath)
+}
+
+// Segment writes a file naming the video and the part of it
+func (f *Fake) Segment(ctx context.Context, videoPath, outputPath string, opts video.SegmentOptions) error {
+	if err := f.start(ctx, "Segment", videoPath); err != nil {
+		return err
+	}
+	return os.WriteFile(outputPath, []byte(SegmentOutput(videoPath, opts)), 0644)
+}
+
+// SegmentOutput is the content of a file written by Fake.Segment
+func SegmentOutput(videoPath string, opts video.SegmentOptions) string {
+	return fmt.Sprintf("MPEG-TS of %s from %s for %s, height %d at %d bits/s",
+		filepath.Base(videoPath), opts.Start, opts.Duration, opts.Height, opts.VideoBitrate)
+}
+
+// Setup installs fake as video.Prober and video.Transcoder, and serves a new
+// empty videos directory with a new data directory until the end of the
+// test. It returns the videos directory. Tests using it must not be parallel.
+func Setup(t testing.TB, fake *Fake) string {
+	t.Helper()
+	prober, transcoder, previous := video.Prober, video.Transcoder, config.Get()
+	t.Cleanup(func() {
+		video.Prober, video.Transcoder = prober, transcoder
+		config.Set(previous)
+	})
+	video.Prober, video.Transcoder = fake, fake
+
+	cfg := config.Defaults()
+	cfg.VideosDir = t.TempDir()
+	cfg.DataDir = t.TempDir()
+	cfg.Watch = false
+	config.Set(cfg)
+	// Runs before the temporary directories are removed
+	t.Cleanup(func() { video.CloseHLSSessions(0) })
+	if err := config.EnsureDirectories(); err != nil {
+		t.Fatal(err)
+	}
+	if err := browse.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg.VideosDir
+}
+
+// WriteFile creates a file of size bytes in dir, with the parent folders of
+// name. Byte i of the file is i%251, so any range of it can be checked.
+func WriteFile(t testing.TB, dir, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
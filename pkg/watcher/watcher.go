@@ -0,0 +1,36 @@
+package watcher
+
+import "errors"
+
+// Op describes what happened to a watched path
+type Op int
+
+const (
+	Create Op = iota // New file or directory, including files renamed into the tree
+	Write            // File content changed
+	Remove           // File or directory deleted or renamed out of the tree
+	Rescan           // Events under the directory were lost, nothing is known to have changed
+)
+
+func (op Op) String() string {
+	switch op {
+	case Create:
+		return "create"
+	case Write:
+		return "write"
+	case Remove:
+		return "remove"
+	case Rescan:
+		return "rescan"
+	}
+	return "unknown"
+}
+
+// Event is a change of a file or directory under the watched tree
+type Event struct {
+	Path  string // Full filesystem path
+	Op    Op
+	IsDir bool
+}
+
+var ErrNotSupported = errors.New("filesystem watching is not supported on this platform")
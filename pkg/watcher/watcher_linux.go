@@ -0,0 +1,178 @@
+//go:build linux
+
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// IN_DONTFOLLOW is missing from the syscall package
+const inDontFollow = 0x2000000
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR | inDontFollow
+
+// Watcher reports changes under a directory tree using inotify.
+// inotify is not recursive, so every directory gets its own watch and new
+// directories are added as they appear.
+type Watcher struct {
+	fd     int
+	file   *os.File
+	root   string
+	hidden bool // Hidden files and directories are reported too
+	handle func(Event)
+
+	mu    sync.Mutex
+	paths map[int32]string // watch descriptor => directory
+}
+
+// New starts watching root, handle is called from a single goroutine for
+// every change. Hidden files and directories are ignored unless hidden is set,
+// like in the listings of the library.
+func New(root string, hidden bool, handle func(Event)) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %w", err)
+	}
+	// A non blocking file goes through the runtime poller, so Close unblocks Read
+	w := &Watcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		root:   root,
+		hidden: hidden,
+		handle: handle,
+		paths:  make(map[int32]string),
+	}
+	if err := w.addTree(root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
+
+// addTree watches dir and all its visible subdirectories
+func (w *Watcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Directory removed in the meantime, or not readable
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != dir && w.ignored(entry.Name()) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			// Most likely fs.inotify.max_user_watches is too low
+			log.Printf("Watcher: cannot watch %s: %v", path, err)
+			return nil
+		}
+		w.mu.Lock()
+		w.paths[int32(wd)] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// removeTree stops watching dir and its subdirectories. Deleted directories
+// lose their watches anyway, this matters for directories moved elsewhere.
+func (w *Watcher) removeTree(dir string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for wd, path := range w.paths {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.paths, wd)
+		}
+	}
+}
+
+func (w *Watcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Watcher: read error: %v", err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+			w.dispatch(raw.Wd, raw.Mask, name)
+		}
+	}
+}
+
+func (w *Watcher) dispatch(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost, the whole tree must be walked again
+		log.Printf("Watcher: event queue overflow, rescanning %s", w.root)
+		w.handle(Event{Path: w.root, Op: Rescan, IsDir: true})
+		return
+	}
+
+	w.mu.Lock()
+	dir, ok := w.paths[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		// The watch was removed, because the directory is gone
+		delete(w.paths, wd)
+	}
+	w.mu.Unlock()
+	if !ok || name == "" || w.ignored(name) {
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	isDir := mask&syscall.IN_ISDIR != 0
+	switch {
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		if isDir {
+			w.removeTree(path)
+		}
+		w.handle(Event{Path: path, Op: Remove, IsDir: isDir})
+	case mask&syscall.IN_MOVED_TO != 0:
+		if isDir {
+			w.addTree(path)
+		}
+		w.handle(Event{Path: path, Op: Create, IsDir: isDir})
+	case mask&syscall.IN_CREATE != 0 && isDir:
+		// Files copied into the directory before the watch was added would
+		// be missed, so the whole directory is reported as new
+		w.addTree(path)
+		w.handle(Event{Path: path, Op: Create, IsDir: true})
+	case mask&syscall.IN_CLOSE_WRITE != 0:
+		// Files are only reported once written, IN_CREATE alone would
+		// report half copied videos
+		w.handle(Event{Path: path, Op: Write})
+	}
+}
+
+// ignored reports if changes of a file or directory are not reported
+func (w *Watcher) ignored(name string) bool {
+	return !w.hidden && name[0] == '.'
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// watch watches a new directory until the end of the test
+func watch(t *testing.T, hidden bool) (string, chan Event) {
+	t.Helper()
+	root := t.TempDir()
+	events := make(chan Event, 100)
+	w, err := New(root, hidden, func(ev Event) { events <- ev })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return root, events
+}
+
+// expect fails the test unless the next event is want
+func expect(t *testing.T, events chan Event, want Event) {
+	t.Helper()
+	select {
+	case ev := <-events:
+		if ev != want {
+			t.Fatalf("event %+v, want %+v", ev, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no event, want %+v", want)
+	}
+}
+
+// expectNone fails the test if an event comes
+func expectNone(t *testing.T, events chan Event) {
+	t.Helper()
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func write(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mkdir(t *testing.T, path string) {
+	t.Helper()
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	root, events := watch(t, false)
+
+	// A file is reported once written, not when created
+	clip := filepath.Join(root, "clip.mp4")
+	file, err := os.Create(clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, events)
+	file.Write([]byte("video"))
+	file.Close()
+	expect(t, events, Event{Path: clip, Op: Write})
+
+	moved := filepath.Join(root, "moved.mp4")
+	if err := os.Rename(clip, moved); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, events, Event{Path: clip, Op: Remove})
+	expect(t, events, Event{Path: moved, Op: Create})
+
+	if err := os.Remove(moved); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, events, Event{Path: moved, Op: Remove})
+
+	// Hidden files are ignored
+	write(t, filepath.Join(root, ".clip.mp4"))
+	expectNone(t, events)
+}
+
+func TestDirectories(t *testing.T) {
+	root, events := watch(t, false)
+	outside := t.TempDir()
+
+	// New directories are watched
+	dir := filepath.Join(root, "talks")
+	mkdir(t, dir)
+	expect(t, events, Event{Path: dir, Op: Create, IsDir: true})
+	write(t, filepath.Join(dir, "a.mp4"))
+	expect(t, events, Event{Path: filepath.Join(dir, "a.mp4"), Op: Write})
+
+	// A directory moved out of the tree is no longer watched
+	if err := os.Rename(dir, filepath.Join(outside, "talks")); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, events, Event{Path: dir, Op: Remove, IsDir: true})
+	write(t, filepath.Join(outside, "talks", "b.mp4"))
+	expectNone(t, events)
+
+	// A directory moved into the tree is watched with its subdirectories
+	mkdir(t, filepath.Join(outside, "talks", "2024"))
+	if err := os.Rename(filepath.Join(outside, "talks"), dir); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, events, Event{Path: dir, Op: Create, IsDir: true})
+	write(t, filepath.Join(dir, "2024", "c.mp4"))
+	expect(t, events, Event{Path: filepath.Join(dir, "2024", "c.mp4"), Op: Write})
+
+	// Hidden directories are not watched
+	hidden := filepath.Join(root, ".trash")
+	mkdir(t, hidden)
+	write(t, filepath.Join(hidden, "d.mp4"))
+	expectNone(t, events)
+}
+
+func TestHiddenFiles(t *testing.T) {
+	// A library listing hidden files
+	root, events := watch(t, true)
+	hidden := filepath.Join(root, ".drafts")
+	mkdir(t, hidden)
+	expect(t, events, Event{Path: hidden, Op: Create, IsDir: true})
+	write(t, filepath.Join(hidden, ".clip.mp4"))
+	expect(t, events, Event{Path: filepath.Join(hidden, ".clip.mp4"), Op: Write})
+}
+
+func TestOverflow(t *testing.T) {
+	root := t.TempDir()
+	events := make(chan Event, 1)
+	w := &Watcher{root: root, handle: func(ev Event) { events <- ev }, paths: make(map[int32]string)}
+
+	// Lost events, reported with the watch descriptor -1
+	w.dispatch(-1, syscall.IN_Q_OVERFLOW, "")
+	expect(t, events, Event{Path: root, Op: Rescan, IsDir: true})
+}
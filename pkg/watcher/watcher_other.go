@@ -0,0 +1,15 @@
+//go:build !linux
+
+package watcher
+
+// Watcher is not available on this platform, changes are only picked up by
+// the periodic scan of the indexer
+type Watcher struct{}
+
+func New(root string, hidden bool, handle func(Event)) (*Watcher, error) {
+	return nil, ErrNotSupported
+}
+
+func (w *Watcher) Close() error {
+	return nil
+}
@@ -4,3 +4,9 @@ import "embed"
 
 //go:embed static
 var StaticFiles embed.FS
+
+// Templates of the HTML fragments, each file can be overridden by a file
+// with the same name in the data directory
+//
+//go:embed templates
+var Templates embed.FS
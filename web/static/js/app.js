@@ -265,22 +265,10 @@ function updateAutoplayButton() {
 }
 
 function getNextVideo(currentPath) {
-  const items = Array.from(document.querySelectorAll(".file-list li"));
-  const currentIndex = items.findIndex((item) =>
-    item.getAttribute("onclick")?.includes(currentPath),
-  );
-  if (currentIndex === -1) return null;
-
-  // Look for next video (skip directories)
-  for (let i = currentIndex + 1; i < items.length; i++) {
-    const item = items[i];
-    if (!item.querySelector(".duration")) continue; // Skip directories
-    const onclick = item.getAttribute("onclick");
-    if (!onclick) continue;
-    const match = onclick.match(/playVideo\('([^']+)'\)/);
-    if (match) return match[1];
-  }
-  return null;
+  const items = Array.from(document.querySelectorAll(".file-list li[data-video]"));
+  const currentIndex = items.findIndex((item) => item.dataset.video === currentPath);
+  if (currentIndex === -1 || currentIndex + 1 >= items.length) return null;
+  return items[currentIndex + 1].dataset.video;
 }
 
 // Video playback utilities
@@ -292,27 +280,116 @@ function updatePlayingClass(path) {
   }
 
   // Add playing class to current video
-  const current = document.querySelector(`.file-list li[onclick*="${CSS.escape(path)}"]`);
+  const current = Array.from(document.querySelectorAll(".file-list li[data-video]")).find(
+    (item) => item.dataset.video === path,
+  );
   if (current) {
     current.classList.add("playing");
   }
 }
 
-function createVideoElement(data, path) {
-  let html =
-    '<video controls autoplay><source src="/api/video/stream?path=' + path + '" type="video/mp4">';
-
-  // Add subtitle tracks if available
-  if (data.info.subtitles && data.info.subtitles.length > 0) {
-    data.info.subtitles.forEach((sub) => {
-      html +=
-        `<track label="${sub.language}" kind="subtitles" srclang="${sub.language}" ` +
-        `src="/api/video/subtitle?path=${path}&lang=${sub.language}">`;
+// hls.js plays HLS through Media Source Extensions in browsers without native
+// HLS (Firefox, most desktop Chrome builds). It is loaded on first use.
+let hlsLoader = null;
+let currentHls = null;
+
+function loadHls() {
+  if (!hlsLoader) {
+    hlsLoader = new Promise((resolve, reject) => {
+      const script = document.createElement("script");
+      script.src = "/static/js/hls.min.js";
+      script.onload = () => resolve(window.Hls);
+      script.onerror = () => reject(new Error("/static/js/hls.min.js could not be loaded"));
+      document.head.appendChild(script);
     });
   }
+  return hlsLoader;
+}
+
+// Videos the browser can't decode are encoded by the server for HLS, played
+// natively or with hls.js. Screens on a weak connection open
+// /static/?adaptive=1 to play every video with HLS, whose quality follows the
+// bandwidth. Without any HLS support the file is sent as is.
+function attachSource(video, data, path) {
+  const stream = "/api/video/stream?path=" + encodeURIComponent(path);
+  if (data.playback !== "hls" && !adaptiveStreaming) {
+    video.dataset.playback = "file";
+    video.src = stream;
+    return;
+  }
+
+  const url = "/api/video/hls/" + path.split("/").map(encodeURIComponent).join("/") + "/index.m3u8";
+  if (video.canPlayType("application/vnd.apple.mpegurl")) {
+    video.dataset.playback = "hls";
+    video.src = url;
+    return;
+  }
+  loadHls()
+    .then((Hls) => {
+      if (!Hls || !Hls.isSupported()) {
+        throw new Error("Media Source Extensions are not available");
+      }
+      if (!video.isConnected) return; // Another video was chosen meanwhile
+      // The rendition follows the measured bandwidth, never above what the
+      // size of the player shows
+      const hls = new Hls({ capLevelToPlayerSize: true });
+      hls.on(Hls.Events.LEVEL_SWITCHED, (event, level) => {
+        const rendition = hls.levels[level.level];
+        console.info("HLS quality:", rendition ? rendition.height + "p" : level.level);
+      });
+      hls.on(Hls.Events.ERROR, (event, error) => {
+        if (!error.fatal) return;
+        console.warn("HLS error:", error.type, error.details);
+        if (error.type === Hls.ErrorTypes.MEDIA_ERROR) {
+          hls.recoverMediaError();
+        } else if (error.type === Hls.ErrorTypes.NETWORK_ERROR) {
+          hls.startLoad();
+        }
+      });
+      hls.loadSource(url);
+      hls.attachMedia(video);
+      video.dataset.playback = "hls.js";
+      currentHls = hls;
+    })
+    .catch((err) => {
+      console.warn("HLS unavailable, playing the file as is:", err.message);
+      if (!video.isConnected) return;
+      video.dataset.playback = "file";
+      video.src = stream;
+      checkAdaptive(video);
+    });
+}
+
+// With adaptive=1 every video must play through HLS: a screen streaming the
+// original file says so instead of silently using its full bitrate
+function checkAdaptive(video) {
+  if (!adaptiveStreaming || video.dataset.playback !== "file") return;
+  console.warn("adaptive=1 is ignored: this browser plays neither HLS nor Media Source Extensions");
+  const notice = document.createElement("div");
+  notice.className = "notice";
+  notice.textContent = "Adaptive streaming is not available in this browser";
+  video.after(notice);
+}
+
+// createVideoElement builds the player through the DOM: names and subtitle
+// languages come from the files and are never parsed as HTML
+function createVideoElement(data, path) {
+  const video = document.createElement("video");
+  video.controls = true;
+  video.autoplay = true;
 
-  html += "</video>";
-  return html;
+  // Add subtitle tracks if available
+  (data.info.subtitles || []).forEach((sub) => {
+    const track = document.createElement("track");
+    track.kind = "subtitles";
+    track.label = sub.language;
+    track.srclang = sub.language;
+    track.src =
+      "/api/video/subtitle?path=" + encodeURIComponent(path) + "&lang=" + encodeURIComponent(sub.language);
+    video.appendChild(track);
+  });
+  attachSource(video, data, path);
+  return video;
 }
 
 function setupVideoElement(video, path) {
@@ -357,20 +434,26 @@ function setupVideoElement(video, path) {
   });
 }
 
+let currentVideoPath = null;
+
 function playVideo(path) {
   // Start video playback with subtitle info
   const player = document.getElementById("player");
+  currentVideoPath = path;
 
   // Fetch video info first
-  fetch("/api/video?path=" + path)
+  fetch("/api/video?path=" + encodeURIComponent(path))
     .then((response) => response.json())
     .then((data) => {
       // Update playing class in file list
       updatePlayingClass(path);
 
       // Create and insert video element
-      const videoHtml = createVideoElement(data, path);
-      player.innerHTML = videoHtml;
+      if (currentHls) {
+        currentHls.destroy();
+        currentHls = null;
+      }
+      player.replaceChildren(createVideoElement(data, path));
 
       // Populate subtitle menu
       populateSubtitleMenu(data.info.subtitles);
@@ -396,6 +479,43 @@ function initVideoEventListeners(video) {
   updatePlayPauseButton(video.paused);
 }
 
+// Live folder updates: the server sends a "folder-changed" event when videos
+// are added or removed, the listing is reloaded if it shows that folder
+function initFolderEvents() {
+  const source = new EventSource("/api/events");
+  source.addEventListener("folder-changed", (event) => {
+    const { path } = JSON.parse(event.data);
+    const list = document.querySelector("#path-browser .file-list");
+    if (!list || list.dataset.path !== path) return;
+    htmx.ajax("GET", "/api/browse/html?path=" + encodeURIComponent(path), {
+      target: "#path-browser",
+      swap: "innerHTML",
+    });
+  });
+  // EventSource reconnects by itself when the server restarts
+}
+
+// Listing options given in the page URL (sort, order, filters) apply to every
+// folder, e.g. /static/?sort=mtime&order=desc shows the latest recordings first
+const listingOptions = new URLSearchParams(window.location.search);
+const adaptiveStreaming = listingOptions.get("adaptive") === "1";
+listingOptions.delete("adaptive");
+document.addEventListener("htmx:configRequest", (event) => {
+  if (!event.detail.path.startsWith("/api/browse/html")) return;
+  for (const [key, value] of listingOptions) {
+    if (!(key in event.detail.parameters)) {
+      event.detail.parameters[key] = value;
+    }
+  }
+});
+
+// Keep the playing video highlighted when the listing is reloaded
+document.addEventListener("htmx:afterSwap", (event) => {
+  if (event.detail.target.id === "path-browser" && currentVideoPath) {
+    updatePlayingClass(currentVideoPath);
+  }
+});
+
 // Initialize on page load
 document.addEventListener("DOMContentLoaded", () => {
   // Set theme (default to light theme)
@@ -418,4 +538,7 @@ document.addEventListener("DOMContentLoaded", () => {
 
   // Initialize video controls if video exists
   initVideoEventListeners(document.querySelector("video"));
+
+  // Refresh the listing when the folder changes on disk
+  initFolderEvents();
 });